@@ -6,6 +6,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"go/build"
 	"image"
@@ -20,6 +21,8 @@ import (
 	"github.com/go-gl/glfw/v3.3/glfw"
 	"github.com/go-gl/mathgl/mgl32"
 	"github.com/hysios/go-ffmpeg-player/player"
+	"github.com/jtestard/tinygo-webrtc/framedump"
+	"github.com/jtestard/tinygo-webrtc/glcapture"
 )
 
 const width = 800
@@ -36,6 +39,15 @@ func init() {
 }
 
 func main() {
+	dumpOptions := framedump.Flags(flag.CommandLine)
+	flag.Parse()
+
+	dumper, err := framedump.New(*dumpOptions)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer dumper.Close()
+
 	if err := glfw.Init(); err != nil {
 		log.Fatalln("failed to initialize glfw:", err)
 	}
@@ -52,10 +64,21 @@ func main() {
 	}
 	window.MakeContextCurrent()
 
+	// F12 saves a screenshot
+	window.SetKeyCallback(func(w *glfw.Window, key glfw.Key, scancode int, action glfw.Action, mods glfw.ModifierKey) {
+		if key == glfw.KeyF12 && action == glfw.Press {
+			dumper.RequestScreenshot()
+		}
+	})
+
 	// Initialize Glow
 	if err := gl.Init(); err != nil {
 		panic(err)
 	}
+	// The frames are dumped through glcapture, which has its own bindings
+	if err := glcapture.Init(nil); err != nil {
+		panic(err)
+	}
 
 	version := gl.GoStr(gl.GetString(gl.VERSION))
 	fmt.Println("OpenGL version", version)
@@ -120,7 +143,7 @@ func main() {
 	angle := 0.0
 	previousTime := glfw.GetTime()
 
-	for !window.ShouldClose() {
+	for !window.ShouldClose() && !dumper.Done() {
 		gl.Clear(gl.COLOR_BUFFER_BIT | gl.DEPTH_BUFFER_BIT)
 
 		// Update
@@ -144,6 +167,14 @@ func main() {
 
 		gl.DrawArrays(gl.TRIANGLES, 0, 6*2*3)
 
+		err := dumper.Capture(func() image.Image {
+			w, h := window.GetFramebufferSize()
+			return glcapture.CaptureSync(0, w, h)
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+
 		// Maintenance
 		window.SwapBuffers()
 		glfw.PollEvents()
@@ -0,0 +1,194 @@
+// Package framedump saves the frames a program renders: every frame to a
+// numbered PNG file while dumping, optionally encoded to a single VP8 IVF file
+// as well, and single screenshots on demand.
+package framedump
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jtestard/tinygo-webrtc/vp8enc"
+)
+
+// Options are the settings of a Dumper
+type Options struct {
+	// Dir is the directory the frames are written to, dumping is off when
+	// empty. Screenshots go there as well, or to the working directory.
+	Dir string
+	// Frames is how many frames are dumped, 0 dumps until the program exits
+	Frames int
+	// IVF is the path of the VP8 IVF file the frames are encoded to as well,
+	// none is written when empty
+	IVF string
+	// FPS is the frame rate written to the IVF file
+	FPS int
+	// Quantizer is the VP8 quantizer index of the IVF frames
+	Quantizer int
+}
+
+// startDir is the directory the program started in. Some programs change to
+// their package directory to find their assets, relative paths given on the
+// command line are still relative to where they were run from.
+var startDir, _ = os.Getwd()
+
+// Flags registers the -dump-frames, -frames, -dump-ivf, -dump-fps and
+// -dump-quantizer flags on fs and returns the options they set
+func Flags(fs *flag.FlagSet) *Options {
+	o := &Options{}
+	fs.StringVar(&o.Dir, "dump-frames", "", "write every rendered frame to a PNG file in this directory")
+	fs.IntVar(&o.Frames, "frames", 0, "exit after dumping this many frames, 0 dumps until the window is closed")
+	fs.StringVar(&o.IVF, "dump-ivf", "", "also encode the dumped frames to this VP8 IVF file")
+	fs.IntVar(&o.FPS, "dump-fps", 30, "frame rate of the IVF file")
+	fs.IntVar(&o.Quantizer, "dump-quantizer", vp8enc.DefaultQuantizer, "VP8 quantizer index of the IVF file, from 0 (best) to 127")
+	return o
+}
+
+// Dumper writes the frames of a program to disk. A Dumper is not safe for
+// concurrent use, programs call it from their render loop.
+type Dumper struct {
+	options Options
+	frames  int
+	encoder *vp8enc.Encoder
+	ivf     *ivfWriter
+	// screenshot is set by the hotkey, the next captured frame is saved
+	screenshot bool
+}
+
+// New creates the directory and the IVF file of o
+func New(o Options) (*Dumper, error) {
+	if o.IVF != "" && o.Dir == "" {
+		return nil, fmt.Errorf("-dump-ivf needs -dump-frames")
+	}
+	if o.Frames < 0 {
+		return nil, fmt.Errorf("invalid frame count %d", o.Frames)
+	}
+	if o.FPS <= 0 {
+		return nil, fmt.Errorf("invalid frame rate %d", o.FPS)
+	}
+	o.Dir = absPath(o.Dir)
+	o.IVF = absPath(o.IVF)
+
+	d := &Dumper{options: o}
+	if o.Dir != "" {
+		if err := os.MkdirAll(o.Dir, 0755); err != nil {
+			return nil, fmt.Errorf("could not create frame directory: %w", err)
+		}
+	}
+	if o.IVF != "" {
+		w, err := newIVFWriter(o.IVF, o.FPS)
+		if err != nil {
+			return nil, fmt.Errorf("could not create IVF file: %w", err)
+		}
+		d.encoder = vp8enc.NewEncoder(o.Quantizer)
+		d.ivf = w
+	}
+	return d, nil
+}
+
+// Dumping reports whether the frames should be passed to Frame, programs
+// skip the readback otherwise
+func (d *Dumper) Dumping() bool {
+	return d.options.Dir != "" && !d.Done()
+}
+
+// Done reports whether the requested number of frames were dumped, and the
+// program should exit
+func (d *Dumper) Done() bool {
+	return d.options.Frames > 0 && d.frames >= d.options.Frames
+}
+
+// RequestScreenshot saves the next frame passed to Capture as a screenshot.
+// Programs call it from their hotkey handler.
+func (d *Dumper) RequestScreenshot() {
+	d.screenshot = true
+}
+
+// Capture reads the frame just rendered with read, when it is dumped or a
+// screenshot was requested, and writes it. It is called once per frame,
+// after drawing and before swapping buffers.
+func (d *Dumper) Capture(read func() image.Image) error {
+	if !d.screenshot && !d.Dumping() {
+		return nil
+	}
+	img := read()
+	if d.screenshot {
+		d.screenshot = false
+		path, err := d.Screenshot(img)
+		if err != nil {
+			return fmt.Errorf("could not save screenshot: %w", err)
+		}
+		log.Println("screenshot saved to", path)
+	}
+	return d.Frame(img)
+}
+
+// Frame writes img as the next frame of the dump, to <dir>/frame-00000.png
+// and so on, and appends it to the IVF file
+func (d *Dumper) Frame(img image.Image) error {
+	if !d.Dumping() {
+		return nil
+	}
+	path := filepath.Join(d.options.Dir, fmt.Sprintf("frame-%05d.png", d.frames))
+	if err := writePNG(path, img); err != nil {
+		return err
+	}
+	if d.ivf != nil {
+		frame, err := d.encoder.Encode(img)
+		if err != nil {
+			return fmt.Errorf("could not encode frame %d: %w", d.frames, err)
+		}
+		if err := d.ivf.writeFrame(frame, img.Bounds().Size()); err != nil {
+			return fmt.Errorf("could not write frame %d: %w", d.frames, err)
+		}
+	}
+	d.frames++
+	return nil
+}
+
+// Screenshot writes img to a PNG file named after the current time, in the
+// dump directory or the working directory, and returns its path
+func (d *Dumper) Screenshot(img image.Image) (string, error) {
+	dir := d.options.Dir
+	if dir == "" {
+		dir = startDir
+	}
+	name := fmt.Sprintf("screenshot-%s.png", time.Now().Format("20060102-150405.000"))
+	path := filepath.Join(dir, name)
+	return path, writePNG(path, img)
+}
+
+// Close finishes the IVF file
+func (d *Dumper) Close() error {
+	if d.ivf == nil {
+		return nil
+	}
+	err := d.ivf.close()
+	d.ivf = nil
+	return err
+}
+
+func writePNG(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return fmt.Errorf("could not encode %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// absPath resolves path from the directory the program started in
+func absPath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(startDir, path)
+}
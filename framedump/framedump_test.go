@@ -0,0 +1,134 @@
+package framedump
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jtestard/tinygo-webrtc/vp8enc"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+)
+
+// TestDump dumps a few frames and checks the PNG files hold them and the IVF
+// file has one frame each
+func TestDump(t *testing.T) {
+	dir := t.TempDir()
+	d, err := New(Options{
+		Dir:       filepath.Join(dir, "frames"),
+		Frames:    3,
+		IVF:       filepath.Join(dir, "frames.ivf"),
+		FPS:       30,
+		Quantizer: vp8enc.DefaultQuantizer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reads := 0
+	for n := 0; !d.Done(); n++ {
+		if n > 3 {
+			t.Fatal("not done after 3 frames")
+		}
+		err := d.Capture(func() image.Image {
+			reads++
+			return filled(64, 48, uint8(n*100))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Capture(func() image.Image { reads++; return nil }); err != nil || reads != 3 {
+		t.Fatalf("read %d frames (err %v), expected 3", reads, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 0; n < 3; n++ {
+		img := decodePNG(t, filepath.Join(dir, "frames", fmt.Sprintf("frame-%05d.png", n)))
+		if got := img.At(10, 10).(color.RGBA).R; got != uint8(n*100) {
+			t.Errorf("frame %d: red is %d, expected %d", n, got, n*100)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, "frames.ivf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ivf, header, err := ivfreader.NewWith(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Width != 64 || header.Height != 48 || header.NumFrames != 3 || header.TimebaseDenominator != 30 {
+		t.Errorf("unexpected IVF header %+v", header)
+	}
+	frames := 0
+	for {
+		_, _, err := ivf.ParseNextFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames++
+	}
+	if frames != 3 {
+		t.Errorf("IVF file has %d frames, expected 3", frames)
+	}
+}
+
+// TestScreenshot saves a screenshot to the working directory without dumping
+func TestScreenshot(t *testing.T) {
+	dir := t.TempDir()
+	defer func(wd string) { startDir = wd }(startDir)
+	startDir = dir
+
+	d, err := New(Options{FPS: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Capture(func() image.Image { t.Fatal("read without a screenshot"); return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	d.RequestScreenshot()
+	if err := d.Capture(func() image.Image { return filled(8, 8, 200) }); err != nil {
+		t.Fatal(err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(matches) != 1 || !strings.HasPrefix(filepath.Base(matches[0]), "screenshot-") {
+		t.Fatalf("found %v, expected a single screenshot", matches)
+	}
+	if got := decodePNG(t, matches[0]).At(0, 0).(color.RGBA).R; got != 200 {
+		t.Errorf("red is %d, expected 200", got)
+	}
+}
+
+func filled(width, height int, red uint8) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = red, 50, 100, 255
+	}
+	return img
+}
+
+func decodePNG(t *testing.T, path string) image.Image {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
@@ -0,0 +1,88 @@
+package framedump
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"os"
+)
+
+// ivfHeaderSize and ivfFrameHeaderSize are the sizes of the file and frame
+// headers of an IVF file
+const (
+	ivfHeaderSize      = 32
+	ivfFrameHeaderSize = 12
+)
+
+// ivfWriter writes VP8 frames to an IVF file, each frame lasting one tick of
+// its time base. The size in the file header is the size of the first frame,
+// and the frame count is filled in on close.
+type ivfWriter struct {
+	file   *os.File
+	fps    int
+	frames uint32
+}
+
+func newIVFWriter(path string, fps int) (*ivfWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	// The header is written with the first frame, once the size is known
+	if _, err := f.Seek(ivfHeaderSize, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &ivfWriter{file: f, fps: fps}, nil
+}
+
+func (w *ivfWriter) writeFrame(frame []byte, size image.Point) error {
+	if w.frames == 0 {
+		if err := w.writeHeader(size); err != nil {
+			return err
+		}
+	}
+	header := make([]byte, ivfFrameHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(frame)))
+	binary.LittleEndian.PutUint64(header[4:], uint64(w.frames))
+	if _, err := w.file.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.file.Write(frame); err != nil {
+		return err
+	}
+	w.frames++
+	return nil
+}
+
+func (w *ivfWriter) writeHeader(size image.Point) error {
+	header := make([]byte, ivfHeaderSize)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0) // version
+	binary.LittleEndian.PutUint16(header[6:], ivfHeaderSize)
+	copy(header[8:], "VP80")
+	binary.LittleEndian.PutUint16(header[12:], uint16(size.X))
+	binary.LittleEndian.PutUint16(header[14:], uint16(size.Y))
+	binary.LittleEndian.PutUint32(header[16:], uint32(w.fps)) // time base denominator
+	binary.LittleEndian.PutUint32(header[20:], 1)             // time base numerator
+	binary.LittleEndian.PutUint32(header[24:], w.frames)
+	_, err := w.file.WriteAt(header, 0)
+	return err
+}
+
+// close updates the frame count and closes the file. A file without any frame
+// is left empty.
+func (w *ivfWriter) close() error {
+	if w.frames > 0 {
+		count := make([]byte, 4)
+		binary.LittleEndian.PutUint32(count, w.frames)
+		if _, err := w.file.WriteAt(count, 24); err != nil {
+			w.file.Close()
+			return fmt.Errorf("could not write frame count: %w", err)
+		}
+	} else if err := w.file.Truncate(0); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
@@ -0,0 +1,127 @@
+// Package glcapture reads back what an OpenGL context rendered, for the
+// Capture of the viewer's Video, the frames the streamer encodes and the ones
+// the GL demos dump with framedump. It uses the all-core bindings whatever
+// version the program renders with, Init loads them.
+package glcapture
+
+import (
+	"image"
+	"image/color"
+	"unsafe"
+
+	"github.com/go-gl/gl/all-core/gl"
+)
+
+// Init loads the OpenGL functions of the package from the current context,
+// through procAddress or through the platform loader when it is nil. Programs
+// call it once their context is current.
+func Init(procAddress func(name string) unsafe.Pointer) error {
+	if procAddress != nil {
+		return gl.InitWithProcAddrFunc(procAddress)
+	}
+	return gl.Init()
+}
+
+// Reader reads frames back through two pixel buffer objects. Each read queues
+// a transfer into one buffer and maps the other, filled by the previous read,
+// so the GPU never has to finish the frame being read. The zero value is ready
+// to use, on the context that was current when Init was called.
+type Reader struct {
+	pbos [2]uint32
+	// sizes are the dimensions of the frame held by each buffer, zero once
+	// it was returned
+	sizes [2]image.Point
+	next  int
+}
+
+// Capture queues the read of the width x height pixels of framebuffer fbo, 0
+// being the back buffer of the window, which must be read after drawing and
+// before SwapBuffers.
+//
+// The readback is asynchronous: Capture returns the frame queued by its
+// previous call, and nil on the first call. Use CaptureSync to get the
+// current frame at the cost of a pipeline stall.
+func (r *Reader) Capture(fbo uint32, width, height int) *image.RGBA {
+	if r.pbos[0] == 0 {
+		gl.GenBuffers(2, &r.pbos[0])
+	}
+	bindFramebufferForRead(fbo)
+
+	// Queue the transfer of this frame
+	gl.BindBuffer(gl.PIXEL_PACK_BUFFER, r.pbos[r.next])
+	gl.BufferData(gl.PIXEL_PACK_BUFFER, width*height*4, nil, gl.STREAM_READ)
+	gl.ReadPixels(0, 0, int32(width), int32(height), gl.RGBA, gl.UNSIGNED_BYTE, gl.PtrOffset(0))
+	r.sizes[r.next] = image.Pt(width, height)
+	r.next = 1 - r.next
+
+	// Map the frame queued last time, its transfer had a frame to complete
+	var img *image.RGBA
+	if prev := r.sizes[r.next]; prev != (image.Point{}) {
+		gl.BindBuffer(gl.PIXEL_PACK_BUFFER, r.pbos[r.next])
+		n := prev.X * prev.Y * 4
+		if ptr := gl.MapBufferRange(gl.PIXEL_PACK_BUFFER, 0, n, gl.MAP_READ_BIT); ptr != nil {
+			img = flipRows((*[1 << 30]byte)(ptr)[:n:n], prev.X, prev.Y)
+			gl.UnmapBuffer(gl.PIXEL_PACK_BUFFER)
+		}
+		r.sizes[r.next] = image.Point{}
+	}
+	gl.BindBuffer(gl.PIXEL_PACK_BUFFER, 0)
+	gl.BindFramebuffer(gl.READ_FRAMEBUFFER, 0)
+	return img
+}
+
+// CaptureSync reads the width x height pixels of framebuffer fbo like
+// Capture, but waits for them. Screenshots and golden image tests want this
+// one.
+func CaptureSync(fbo uint32, width, height int) *image.RGBA {
+	bindFramebufferForRead(fbo)
+	pix := make([]byte, width*height*4)
+	gl.ReadPixels(0, 0, int32(width), int32(height), gl.RGBA, gl.UNSIGNED_BYTE, gl.Ptr(pix))
+	gl.BindFramebuffer(gl.READ_FRAMEBUFFER, 0)
+	return flipRows(pix, width, height)
+}
+
+// bindFramebufferForRead reads from the first color attachment of fbo, or from
+// the back buffer of the window, with tightly packed rows
+func bindFramebufferForRead(fbo uint32) {
+	gl.BindFramebuffer(gl.READ_FRAMEBUFFER, fbo)
+	if fbo == 0 {
+		gl.ReadBuffer(gl.BACK)
+	} else {
+		gl.ReadBuffer(gl.COLOR_ATTACHMENT0)
+	}
+	gl.PixelStorei(gl.PACK_ALIGNMENT, 4)
+	gl.PixelStorei(gl.PACK_ROW_LENGTH, 0)
+}
+
+// flipRows copies the rows read by OpenGL, which start at the bottom, into
+// an image starting at the top
+func flipRows(pix []byte, width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		copy(img.Pix[y*img.Stride:(y+1)*img.Stride], pix[(height-1-y)*width*4:])
+	}
+	return img
+}
+
+// I420 converts a captured frame to 4:2:0 YCbCr, the layout video encoders
+// take. Each chroma sample is the average of the 2x2 pixels it covers.
+func I420(img *image.RGBA) *image.YCbCr {
+	b := img.Bounds()
+	out := image.NewYCbCr(b, image.YCbCrSubsampleRatio420)
+	w, h := b.Dx(), b.Dy()
+	for cy := 0; cy < (h+1)/2; cy++ {
+		for cx := 0; cx < (w+1)/2; cx++ {
+			var r, g, bl, n int
+			for y := 2 * cy; y < 2*cy+2 && y < h; y++ {
+				for x := 2 * cx; x < 2*cx+2 && x < w; x++ {
+					p := img.Pix[img.PixOffset(b.Min.X+x, b.Min.Y+y):]
+					out.Y[y*out.YStride+x], _, _ = color.RGBToYCbCr(p[0], p[1], p[2])
+					r, g, bl, n = r+int(p[0]), g+int(p[1]), bl+int(p[2]), n+1
+				}
+			}
+			_, out.Cb[cy*out.CStride+cx], out.Cr[cy*out.CStride+cx] = color.RGBToYCbCr(uint8(r/n), uint8(g/n), uint8(bl/n))
+		}
+	}
+	return out
+}
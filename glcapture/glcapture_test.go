@@ -0,0 +1,132 @@
+package glcapture
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/go-gl/gl/all-core/gl"
+	"github.com/jtestard/tinygo-webrtc/offscreen"
+)
+
+var (
+	red  = color.RGBA{255, 0, 0, 255}
+	blue = color.RGBA{0, 0, 255, 255}
+)
+
+// newContext makes an offscreen context of width x height pixels current
+func newContext(t *testing.T, width, height int) *offscreen.Window {
+	window, err := offscreen.NewWindow(width, height)
+	if err != nil {
+		t.Skipf("no offscreen rendering on this machine: %v", err)
+	}
+	window.MakeContextCurrent()
+	if err := Init(window.ProcAddress); err != nil {
+		t.Fatal(err)
+	}
+	return window
+}
+
+// drawHalves clears the top half of the bound framebuffer to top and the
+// bottom half to bottom
+func drawHalves(width, height int, top, bottom color.RGBA) {
+	gl.Enable(gl.SCISSOR_TEST)
+	defer gl.Disable(gl.SCISSOR_TEST)
+	for _, half := range []struct {
+		y int
+		c color.RGBA
+	}{{height / 2, top}, {0, bottom}} {
+		gl.Scissor(0, int32(half.y), int32(width), int32(height/2))
+		gl.ClearColor(float32(half.c.R)/255, float32(half.c.G)/255, float32(half.c.B)/255, 1)
+		gl.Clear(gl.COLOR_BUFFER_BIT)
+	}
+}
+
+func checkHalves(t *testing.T, name string, img *image.RGBA, top, bottom color.RGBA) {
+	t.Helper()
+	if img == nil {
+		t.Fatalf("%s: no frame", name)
+	}
+	b := img.Bounds()
+	if got := img.RGBAAt(b.Dx()/2, 0); got != top {
+		t.Errorf("%s: top is %v, expected %v", name, got, top)
+	}
+	if got := img.RGBAAt(b.Dx()/2, b.Dy()-1); got != bottom {
+		t.Errorf("%s: bottom is %v, expected %v", name, got, bottom)
+	}
+}
+
+// TestCapture checks that frames are read top first, and that Capture returns
+// each frame at the next call
+func TestCapture(t *testing.T) {
+	window := newContext(t, 64, 48)
+	defer window.Destroy()
+
+	drawHalves(64, 48, red, blue)
+	checkHalves(t, "CaptureSync", CaptureSync(0, 64, 48), red, blue)
+
+	r := &Reader{}
+	if img := r.Capture(0, 64, 48); img != nil {
+		t.Error("first Capture returned a frame")
+	}
+	drawHalves(64, 48, blue, red)
+	checkHalves(t, "Capture of the first frame", r.Capture(0, 64, 48), red, blue)
+	drawHalves(64, 48, red, red)
+	checkHalves(t, "Capture of the second frame", r.Capture(0, 64, 48), blue, red)
+}
+
+// TestCaptureFramebuffer reads a framebuffer object, like the one of a core
+// rendering in hardware, of another size than the window
+func TestCaptureFramebuffer(t *testing.T) {
+	window := newContext(t, 64, 48)
+	defer window.Destroy()
+
+	var fbo, rbo uint32
+	gl.GenFramebuffers(1, &fbo)
+	gl.GenRenderbuffers(1, &rbo)
+	gl.BindRenderbuffer(gl.RENDERBUFFER, rbo)
+	gl.RenderbufferStorage(gl.RENDERBUFFER, gl.RGBA8, 30, 20)
+	gl.BindFramebuffer(gl.FRAMEBUFFER, fbo)
+	gl.FramebufferRenderbuffer(gl.FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.RENDERBUFFER, rbo)
+	if status := gl.CheckFramebufferStatus(gl.FRAMEBUFFER); status != gl.FRAMEBUFFER_COMPLETE {
+		t.Fatalf("framebuffer status %#x", status)
+	}
+	drawHalves(30, 20, blue, red)
+	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
+
+	img := CaptureSync(fbo, 30, 20)
+	if img.Bounds() != image.Rect(0, 0, 30, 20) {
+		t.Fatalf("read a %v frame", img.Bounds())
+	}
+	checkHalves(t, "CaptureSync", img, blue, red)
+
+	r := &Reader{}
+	r.Capture(fbo, 30, 20)
+	checkHalves(t, "Capture", r.Capture(fbo, 30, 20), blue, red)
+}
+
+// TestI420 converts a frame of odd dimensions, whose last chroma samples cover
+// a single row or column of pixels
+func TestI420(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 5, 3))
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 5; x++ {
+			img.SetRGBA(x, y, red)
+		}
+	}
+	img.SetRGBA(4, 2, blue)
+
+	out := I420(img)
+	ry, rcb, rcr := color.RGBToYCbCr(255, 0, 0)
+	by, bcb, bcr := color.RGBToYCbCr(0, 0, 255)
+	if out.Y[0] != ry || out.Y[2*out.YStride+4] != by {
+		t.Errorf("luma is %d and %d, expected %d and %d", out.Y[0], out.Y[2*out.YStride+4], ry, by)
+	}
+	if out.Cb[0] != rcb || out.Cr[0] != rcr {
+		t.Errorf("chroma of the red pixels is %d, %d, expected %d, %d", out.Cb[0], out.Cr[0], rcb, rcr)
+	}
+	// The bottom right sample covers the blue pixel alone
+	if c := out.COffset(4, 2); out.Cb[c] != bcb || out.Cr[c] != bcr {
+		t.Errorf("chroma of the blue pixel is %d, %d, expected %d, %d", out.Cb[c], out.Cr[c], bcb, bcr)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jtestard/tinygo-webrtc/rtcconfig"
+	"github.com/jtestard/tinygo-webrtc/webrtcclient"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// TestEcho sends the test pattern and checks that its VP8 frames come back
+func TestEcho(t *testing.T) {
+	rtcConfig = rtcconfig.Default()
+	rtcConfig.HostOnly = true
+	server := httptest.NewServer(newHandler())
+	defer server.Close()
+
+	c, err := webrtcclient.Dial(server.URL, webrtcclient.Options{SendVideo: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.SendPattern(ctx, 64, 64, 30)
+
+	packet, err := waitKeyframe(c, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.Kind != webrtc.RTPCodecTypeVideo || !strings.EqualFold(packet.MimeType, webrtc.MimeTypeVP8) {
+		t.Errorf("echoed %s %s, expected VP8 video", packet.MimeType, packet.Kind)
+	}
+	s := sessions.Get(c.ID)
+	if s == nil {
+		t.Fatalf("session %s is not registered", c.ID)
+	}
+	// The client sends no sender reports, only the transport counts what it
+	// sent
+	if stats := s.Stats(); stats.BytesReceived == 0 {
+		t.Errorf("stats do not count the bytes received: %+v", stats)
+	}
+}
+
+var errNoKeyframe = errors.New("no key frame received")
+
+// waitKeyframe returns the first packet received by c starting a VP8 key
+// frame
+func waitKeyframe(c *webrtcclient.Client, timeout time.Duration) (webrtcclient.Packet, error) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case packet := <-c.Packets():
+			if isKeyframeStart(packet) {
+				return packet, nil
+			}
+		case <-deadline:
+			return webrtcclient.Packet{}, errNoKeyframe
+		}
+	}
+}
+
+// isKeyframeStart reports whether packet holds the start of a VP8 key frame,
+// whose frame tag has bit 0 cleared and is followed by the 9d 01 2a start code
+func isKeyframeStart(packet webrtcclient.Packet) bool {
+	vp8 := codecs.VP8Packet{}
+	payload, err := vp8.Unmarshal(packet.RTP.Payload)
+	if err != nil || vp8.S == 0 || len(payload) < 6 {
+		return false
+	}
+	return payload[0]&0x01 == 0 && payload[3] == 0x9d && payload[4] == 0x01 && payload[5] == 0x2a
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// keyframeRequestInterval is the minimum time between two keyframe requests
+// sent to the publisher
+const keyframeRequestInterval = time.Second
+
+// keyframeForwarder forwards the keyframe requests (PLI and FIR) the viewer
+// sends about the echoed track to the publisher of the original track
+type keyframeForwarder struct {
+	peerConnection *webrtc.PeerConnection
+
+	lock sync.Mutex
+	// mediaSSRC is the SSRC of the publisher track, 0 until it started
+	mediaSSRC uint32
+	last      time.Time
+}
+
+// setPublisher is called once the publisher track started. A keyframe is
+// requested right away so that the echo does not wait for the next one.
+func (f *keyframeForwarder) setPublisher(ssrc uint32) {
+	f.lock.Lock()
+	f.mediaSSRC = ssrc
+	f.lock.Unlock()
+	f.request()
+}
+
+// request sends a PLI to the publisher unless one was sent less than
+// keyframeRequestInterval ago, the keyframe it triggers serves both requests
+func (f *keyframeForwarder) request() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.mediaSSRC == 0 || time.Since(f.last) < keyframeRequestInterval {
+		return
+	}
+	f.last = time.Now()
+
+	if err := f.peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: f.mediaSSRC}}); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// handleRTCP forwards the keyframe requests the viewer sends about the echoed
+// track
+func (f *keyframeForwarder) handleRTCP(packet rtcp.Packet) {
+	switch packet.(type) {
+	case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+		f.request()
+	}
+}
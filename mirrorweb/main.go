@@ -1,29 +1,57 @@
- package main
-
- import (
-	 "encoding/base64"
-	 "encoding/json"
-	 "fmt"
-	 "github.com/pion/rtcp"
-	 "github.com/pion/webrtc"
-	 "html/template"
-	 "io"
-	 "io/ioutil"
-	 "log"
-	 "math/rand"
-	 "net/http"
-	 "sync"
-	 "time"
- )
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jtestard/tinygo-webrtc/rtcconfig"
+	"github.com/jtestard/tinygo-webrtc/rtcsession"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// rtcConfig holds the listen address and the ICE settings of the server
+var rtcConfig *rtcconfig.Config
 
 func main() {
-	// Block forever
-	http.HandleFunc("/", getWeb)
-	http.HandleFunc("/webrtc/open", startWebRTCSession)
-	http.HandleFunc("/webrtc/close", closeWebRTCSession)
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-	fmt.Println("now serving on localhost:8000")
-	checkNoError(http.ListenAndServe(":8000", nil))
+	loadConfig := rtcconfig.Flags(flag.CommandLine)
+	flag.StringVar(&recordDir, "record", "", "directory to record every session to, as <session ID>.ivf and <session ID>.ogg")
+	flag.Parse()
+	var err error
+	rtcConfig, err = loadConfig()
+	checkNoError(err)
+	checkNoError(rtcConfig.Open())
+
+	fmt.Printf("now serving on %s\n", rtcConfig.Listen)
+	err = rtcsession.Serve(rtcConfig.Listen, newHandler(), sessions)
+	rtcConfig.Close()
+	checkNoError(err)
+}
+
+// newHandler routes the requests of the server, tests serve it with httptest
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", getWeb)
+	mux.HandleFunc("/webrtc/open", startWebRTCSession)
+	mux.HandleFunc("/webrtc/close", closeWebRTCSession)
+	mux.HandleFunc("/webrtc/ws", rtcsession.WebSocketHandler(sessions, openSession))
+	mux.HandleFunc("/webrtc/stats", rtcsession.StatsHandler(sessions))
+	mux.HandleFunc("/webrtc/config", getConfig)
+	mux.Handle("/metrics", rtcsession.MetricsHandler)
+	mux.HandleFunc(whipPath, whipHandler)
+	mux.HandleFunc(whipPath+"/", whipHandler)
+	mux.Handle("/static/stats.js", rtcsession.StatsScript)
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	return mux
 }
 
 func checkNoError(err error) {
@@ -36,144 +64,259 @@ func checkNoError(err error) {
 func getWeb(w http.ResponseWriter, r *http.Request) {
 	tmpl, err := template.ParseFiles("demo.html")
 	if err != nil {
-		log.Fatal(err)
+		rtcsession.WriteError(w, rtcsession.ErrInternal(err))
+		return
 	}
 
-	tmpl.Execute(w, nil)
+	tmpl.Execute(w, rtcConfig.Frontend())
+}
+
+// getConfig returns the configuration the browser must create its peer
+// connection with
+func getConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rtcConfig.Frontend()); err != nil {
+		log.Printf("could not send configuration: %v\n", err)
+	}
 }
 
-var peerConnection *webrtc.PeerConnection
-var lock sync.Mutex
+// sessions are the open sessions, by ID
+var sessions = rtcsession.NewRegistry()
+
+// sessionResponse is returned by /webrtc/open. The ID must be passed back to /webrtc/close
+type sessionResponse struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+}
 
 func closeWebRTCSession(w http.ResponseWriter, r *http.Request) {
-	if peerConnection == nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("session already closed/never opened"))
+	id := r.URL.Query().Get("id")
+	s := sessions.Remove(id)
+	if s == nil {
+		rtcsession.WriteError(w, rtcsession.ErrSessionNotFound(id))
 		return
 	}
-	checkNoError(peerConnection.Close())
-	peerConnection = nil
+	if err := s.Close(); err != nil {
+		rtcsession.WriteError(w, rtcsession.ErrInternal(err))
+		return
+	}
+	fmt.Printf("session %s closed\n", s.ID)
 }
 
-
 func startWebRTCSession(w http.ResponseWriter, r *http.Request) {
-	if peerConnection != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("session already started. Please close before re-opening"))
-		return
-	}
+	start := time.Now()
+	var err error
+	defer func() { rtcsession.ObserveOpen("open", start, err) }()
 
-	// Everything below is the Pion WebRTC API! Thanks for using it ❤️.
 	buf, err := ioutil.ReadAll(r.Body)
-	checkNoError(err)
+	if err != nil {
+		err = rtcsession.ErrBadOffer(err)
+		rtcsession.WriteError(w, err)
+		return
+	}
 
 	// The mirrorweb rtc offer is sent over in the body of the request
 	offer := webrtc.SessionDescription{}
-	decode(string(buf), &offer)
+	if err = decode(string(buf), &offer); err != nil {
+		err = rtcsession.ErrBadOffer(err)
+		rtcsession.WriteError(w, err)
+		return
+	}
 
-	// We make our own mediaEngine so we can place the sender's codecs in it. Since we are echoing their RTP packet
-	// back to them we are actually codec agnostic - we can accept all their codecs. This also ensures that we use the
-	// dynamic media type from the sender in our answer.
-	mediaEngine := webrtc.MediaEngine{}
-
-	// Add codecs to the mediaEngine. Note that even though we are only going to echo back the sender's video we also
-	// add audio codecs. This is because createAnswer will create an audioTransceiver and associated SDP and we currently
-	// cannot tell it not to. The audio SDP must match the sender's codecs too...
-	err = mediaEngine.PopulateFromSDP(offer)
-	checkNoError(err)
+	s, answer, err := openSession(offer, nil)
+	if err != nil {
+		rtcsession.WriteError(w, err)
+		return
+	}
 
-	videoCodecs := mediaEngine.GetCodecsByKind(webrtc.RTPCodecTypeVideo)
-	if len(videoCodecs) == 0 {
-		panic("Offer contained no video codecs")
+	// return the session ID and the answer in base64 to the browser
+	w.Header().Set("Content-Type", "application/json")
+	if encodeErr := json.NewEncoder(w).Encode(sessionResponse{ID: s.ID, Description: encode(answer)}); encodeErr != nil {
+		log.Printf("session %s: could not send response: %v\n", s.ID, encodeErr)
+		return
 	}
+	fmt.Printf("session %s: response sent to browser\n", s.ID)
 
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
+	// print the answer to the logs
+	fmt.Println(encode(answer))
+}
+
+// echoKinds are the kinds of tracks echoed back, each on its own output track
+var echoKinds = []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio}
+
+// openSession creates the echo peer connection for offer and registers it. When
+// onCandidate is set the local candidates are trickled to it instead of being
+// gathered into the answer. On failure the peer connection is closed so that
+// no half-initialised session is left behind.
+func openSession(offer webrtc.SessionDescription, onCandidate func(*webrtc.ICECandidate)) (s *rtcsession.Session, answer webrtc.SessionDescription, err error) {
+	// Everything below is the Pion WebRTC API! Thanks for using it ❤️.
 
-	// Prepare the configuration
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
+	// We make our own mediaEngine so we can place the sender's codecs in it. Since we are echoing their RTP packet
+	// back to them we are actually codec agnostic - we can accept any of their codecs. This also ensures that we use
+	// the dynamic media type from the sender in our answer.
+	//
+	// Every track is echoed on an output track of its own codec, so the answer accepts a single codec per kind, the
+	// first one the sender offers. The sender then sends with the codec and payload type of its echo.
+	mediaEngine := &webrtc.MediaEngine{}
+	echoCodecs := map[webrtc.RTPCodecType]webrtc.RTPCodecParameters{}
+	for _, kind := range echoKinds {
+		codecs, offerErr := rtcsession.OfferedCodecs(offer, kind)
+		if offerErr != nil {
+			return nil, answer, offerErr
+		}
+		if len(codecs) == 0 {
+			continue
+		}
+		echoCodecs[kind] = codecs[0]
+		if err = mediaEngine.RegisterCodec(codecs[0], kind); err != nil {
+			return nil, answer, rtcsession.ErrInternal(err)
+		}
+	}
+	if _, ok := echoCodecs[webrtc.RTPCodecTypeVideo]; !ok {
+		return nil, answer, rtcsession.ErrUnsupportedCodec("offer contained no video codecs")
+	}
+
+	// Create a new RTCPeerConnection with the configured ICE servers and ports
+	peerConnection, err := rtcConfig.NewPeerConnection(mediaEngine)
+	if err != nil {
+		return nil, answer, rtcsession.ErrInternal(err)
+	}
+	sess := sessions.New(peerConnection)
+	defer func() {
+		if err != nil {
+			sess.Abort()
+		}
+	}()
+
+	// The recording is finalised once the session is closed
+	var rec *recorder
+	if recordDir != "" {
+		rec = newRecorder(recordDir, sess.ID)
+		sess.OnClose(rec.close)
 	}
-	// Create a new RTCPeerConnection
-	peerConnection, err = api.NewPeerConnection(config)
-	checkNoError(err)
 
 	// Set the remote SessionDescription
-	err = peerConnection.SetRemoteDescription(offer)
-	checkNoError(err)
+	if err = peerConnection.SetRemoteDescription(offer); err != nil {
+		return nil, answer, rtcsession.ErrBadOffer(err)
+	}
 
-	// Create Track that we send video back to browser on
-	outputTrack, err := peerConnection.NewTrack(videoCodecs[0].PayloadType, rand.Uint32(), "video", "pion")
-	checkNoError(err)
+	// Create the Tracks that we send back to browser on, one per kind with the codec negotiated for it. Audio and
+	// video share a stream so that the browser keeps them in sync
+	keyframes := &keyframeForwarder{peerConnection: peerConnection}
+	outputTracks := map[webrtc.RTPCodecType]*rtcsession.Track{}
+	for _, kind := range echoKinds {
+		codec, ok := echoCodecs[kind]
+		if !ok {
+			continue
+		}
+		outputTrack, trackErr := webrtc.NewTrackLocalStaticRTP(codec.RTPCodecCapability, kind.String(), "pion")
+		if trackErr != nil {
+			return nil, answer, rtcsession.ErrInternal(trackErr)
+		}
 
-	// Add this newly created track to the PeerConnection
-	_, err = peerConnection.AddTrack(outputTrack)
-	checkNoError(err)
+		// Add this newly created track to the PeerConnection, the session sends the sender reports about it
+		reported, sender, trackErr := sess.AddTrack(outputTrack)
+		if trackErr != nil {
+			return nil, answer, rtcsession.ErrInternal(trackErr)
+		}
+		outputTracks[kind] = reported
+
+		// Keyframe requests from the browser about the echo are forwarded to the track it publishes
+		if kind == webrtc.RTPCodecTypeVideo {
+			go sess.RTCP.ReadRTCP(sender, keyframes.handleRTCP)
+		} else {
+			go sess.RTCP.ReadRTCP(sender, nil)
+		}
+	}
 
 	// Set a handler for when a new remote track starts, this handler copies inbound RTP packets,
-	// replaces the SSRC and sends them back
-	peerConnection.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
-		// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
-		// This is a temporary fix until we implement incoming RTCP events, then we would push a PLI only when a viewer requests it
-		doneChan := make(chan struct{})
-		go func() {
-			ticker := time.NewTicker(time.Second * 3)
-			loop:
-			for {
-				select {
-					case <- ticker.C:
-						errSend := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: track.SSRC()}})
-						if errSend != nil {
-							fmt.Println(errSend)
-						}
-					case <-doneChan:
-						break loop
-				}
+	// replaces the SSRC and sends them back on the output track of the same codec
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		fmt.Printf("Track has started, of type %d: %s \n", track.PayloadType(), track.Codec().MimeType)
+
+		// The payload type of the packets is the one negotiated for the echo. A track sent with another codec than
+		// the one its echo was created with is not echoed.
+		outputTrack, ok := outputTracks[track.Kind()]
+		if !ok || !strings.EqualFold(outputTrack.Codec().MimeType, track.Codec().MimeType) {
+			log.Printf("session %s: no output track for %s %s, not echoing it\n", sess.ID, track.Kind(), track.Codec().MimeType)
+			return
+		}
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			keyframes.setPublisher(uint32(track.SSRC()))
+		}
+		// The sender reports of the browser about the track give the packets it sent
+		go sess.RTCP.ReadRTCP(receiver, nil)
+
+		// Record what the browser sends if recording is on
+		var recording media.Writer
+		if rec != nil {
+			var recordErr error
+			if recording, recordErr = rec.addTrack(track); recordErr != nil {
+				log.Printf("session %s: %v\n", sess.ID, recordErr)
 			}
-		}()
+		}
 
-		fmt.Printf("Track has started, of type %d: %s \n", track.PayloadType(), track.Codec().Name)
 		for {
 			// Read RTP packets being sent to Pion
-			rtp, readErr := track.ReadRTP()
+			rtp, _, readErr := track.ReadRTP()
 			if readErr == io.EOF {
-				doneChan <- struct{}{}
-				break
+				return
+			} else if readErr != nil {
+				log.Printf("could not read RTP: %v\n", readErr)
+				return
+			}
+			rtcsession.CountInboundRTP(track.Kind(), rtp)
+
+			if recording != nil {
+				if recordErr := rec.write(recording, rtp); recordErr != nil {
+					log.Printf("session %s: could not record RTP: %v\n", sess.ID, recordErr)
+				}
 			}
-			checkNoError(readErr)
 
 			// Replace the SSRC with the SSRC of the outbound track.
-			// The only change we are making replacing the SSRC, the RTP packets are unchanged otherwise
+			// The only change we are making replacing the SSRC, the RTP packets are unchanged otherwise, timestamps
+			// included, which keeps audio and video in sync
 			rtp.SSRC = outputTrack.SSRC()
 
-			writeErr := outputTrack.WriteRTP(rtp)
-			checkNoError(writeErr)
+			if writeErr := outputTrack.WriteRTP(rtp); writeErr != nil {
+				log.Printf("could not write RTP: %v\n", writeErr)
+				return
+			}
 		}
 	})
 	// Set the handler for ICE connection state
 	// This will notify you when the peer has connected/disconnected
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		fmt.Printf("Connection State has changed %s \n", connectionState.String())
+		sess.WatchICE(connectionState)
 	})
 
+	// Without trickle the answer lists every candidate, it is only complete once
+	// gathering is
+	var gathered <-chan struct{}
+	if onCandidate != nil {
+		peerConnection.OnICECandidate(onCandidate)
+	} else {
+		gathered = webrtc.GatheringCompletePromise(peerConnection)
+	}
+
 	// Create an answer
-	answer, err := peerConnection.CreateAnswer(nil)
-	checkNoError(err)
+	answer, err = peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return nil, answer, rtcsession.ErrInternal(err)
+	}
 
 	// Sets the LocalDescription, and starts our UDP listeners
-	err = peerConnection.SetLocalDescription(answer)
-	checkNoError(err)
-
-	// return the answer to the browser in base64
-	_, err = w.Write([]byte(encode(answer)))
-	checkNoError(err)
-	fmt.Println("response sent to browser")
+	if err = peerConnection.SetLocalDescription(answer); err != nil {
+		return nil, answer, rtcsession.ErrInternal(err)
+	}
+	if gathered != nil {
+		<-gathered
+		answer = *peerConnection.LocalDescription()
+	}
 
-	// print the answer to the logs
-	fmt.Println(encode(answer))
+	// Register the session so that it can be closed later on
+	return sessions.Add(sess), answer, nil
 }
 
 // Encode encodes the input in base64
@@ -189,14 +332,11 @@ func encode(obj interface{}) string {
 
 // Decode decodes the input from base64
 // It can optionally unzip the input after decoding
-func decode(in string, obj interface{}) {
+func decode(in string, obj interface{}) error {
 	b, err := base64.StdEncoding.DecodeString(in)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	err = json.Unmarshal(b, obj)
-	if err != nil {
-		panic(err)
-	}
+	return json.Unmarshal(b, obj)
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jtestard/tinygo-webrtc/rtcconfig"
+	"github.com/jtestard/tinygo-webrtc/webrtcclient"
+	"github.com/pion/webrtc/v3"
+)
+
+// TestUDPMux runs two echo sessions at once with the single port mode on and
+// checks that both are echoed through the mux port at the same time
+func TestUDPMux(t *testing.T) {
+	rtcConfig = rtcconfig.Default()
+	rtcConfig.HostOnly = true
+	rtcConfig.UDPMuxPort = freePort(t, "udp4")
+	if err := rtcConfig.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer rtcConfig.Close()
+
+	testConcurrentEchoes(t, rtcConfig.UDPMuxPort, webrtc.NetworkTypeUDP4)
+}
+
+// TestTCPMux does the same as TestUDPMux over ICE-TCP, with UDP left out on
+// both ends
+func TestTCPMux(t *testing.T) {
+	rtcConfig = rtcconfig.Default()
+	rtcConfig.HostOnly = true
+	rtcConfig.TCPMuxPort = freePort(t, "tcp4")
+	if err := rtcConfig.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer rtcConfig.Close()
+
+	testConcurrentEchoes(t, rtcConfig.TCPMuxPort, webrtc.NetworkTypeTCP4)
+}
+
+// testConcurrentEchoes opens two echo sessions in parallel with clients
+// gathering candidates of networkType only. Once both are echoed, and while
+// both are still open, it checks that the candidate pair of each goes through
+// port on the server side.
+func testConcurrentEchoes(t *testing.T, port int, networkType webrtc.NetworkType) {
+	server := httptest.NewServer(newHandler())
+	defer server.Close()
+
+	type result struct {
+		client *webrtcclient.Client
+		err    error
+	}
+	results := make(chan result)
+	for i := 0; i < 2; i++ {
+		go func() {
+			c, err := echoSession(server.URL, networkType)
+			results <- result{c, err}
+		}()
+	}
+
+	var clients []*webrtcclient.Client
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Error(r.err)
+			continue
+		}
+		defer r.client.Close()
+		clients = append(clients, r.client)
+	}
+	if len(clients) != 2 {
+		return
+	}
+
+	for i, c := range clients {
+		if state := c.PeerConnection().ICEConnectionState(); state != webrtc.ICEConnectionStateConnected {
+			t.Errorf("client %d is %s while the other is connected", i, state)
+		}
+		s := sessions.Get(c.ID)
+		if s == nil {
+			t.Fatalf("session %d was closed", i)
+		}
+		pair := s.Stats().CandidatePair
+		if pair == nil {
+			t.Errorf("session %d selected no candidate pair", i)
+		} else if int(pair.Local.Port) != port {
+			t.Errorf("session %d goes through port %d instead of %d", i, pair.Local.Port, port)
+		}
+	}
+}
+
+// echoSession opens a session on the server at url, with a client gathering
+// candidates of networkType only, and sends it video until it is echoed back.
+// The session is left open.
+func echoSession(url string, networkType webrtc.NetworkType) (*webrtcclient.Client, error) {
+	c, err := webrtcclient.Dial(url, webrtcclient.Options{SendVideo: true, NetworkTypes: []webrtc.NetworkType{networkType}})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.SendPattern(ctx, 64, 64, 30)
+
+	if _, err = waitKeyframe(c, 10*time.Second); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// freePort returns a port of network nobody listens on
+func freePort(t *testing.T, network string) int {
+	if network == "tcp4" {
+		listener, err := net.Listen(network, "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		return listener.Addr().(*net.TCPAddr).Port
+	}
+	conn, err := net.ListenUDP(network, &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jtestard/tinygo-webrtc/rtcsession"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// recordDir is the directory sessions are recorded to, recording is off when empty
+var recordDir string
+
+// recorder writes the tracks a browser publishes to disk: VP8 video to
+// <dir>/<session ID>.ivf and Opus audio to <dir>/<session ID>.ogg
+type recorder struct {
+	dir string
+	id  string
+
+	lock    sync.Mutex
+	writers []media.Writer
+	closed  bool
+}
+
+func newRecorder(dir, id string) *recorder {
+	return &recorder{dir: dir, id: id}
+}
+
+// addTrack creates the file track is recorded to. It returns nil when the
+// codec of track cannot be recorded.
+func (r *recorder) addTrack(track *webrtc.TrackRemote) (media.Writer, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil, nil
+	}
+
+	var writer media.Writer
+	var err error
+	codec := rtcsession.CodecName(track.Codec().MimeType)
+	switch strings.ToLower(codec) {
+	case "vp8":
+		writer, err = ivfwriter.New(filepath.Join(r.dir, r.id+".ivf"))
+	case "opus":
+		writer, err = oggwriter.New(filepath.Join(r.dir, r.id+".ogg"), track.Codec().ClockRate, track.Codec().Channels)
+	default:
+		log.Printf("session %s: cannot record %s tracks\n", r.id, codec)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create recording: %w", err)
+	}
+	r.writers = append(r.writers, writer)
+	return writer, nil
+}
+
+// write depacketizes packet into writer, nothing is written once the recorder
+// is closed
+func (r *recorder) write(writer media.Writer, packet *rtp.Packet) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil
+	}
+	return writer.WriteRTP(packet)
+}
+
+// close finalises every file of the recording. It can be called more than once.
+func (r *recorder) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	for _, writer := range r.writers {
+		if err := writer.Close(); err != nil {
+			log.Printf("session %s: could not finalise recording: %v\n", r.id, err)
+		}
+	}
+	fmt.Printf("session %s: recording finalised\n", r.id)
+}
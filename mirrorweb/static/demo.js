@@ -1,12 +1,7 @@
 /* eslint-env browser */
 $(document).ready(() => {
-  let pc = new RTCPeerConnection({
-    iceServers: [
-      {
-        urls: 'stun:stun.l.google.com:19302'
-      }
-    ]
-  })
+  // The server renders its ICE configuration into the page, see /webrtc/config
+  let pc = new RTCPeerConnection(window.rtcConfig)
   var log = msg => {
     $('#logs').append(msg + '<br>');
   }
@@ -18,14 +13,23 @@ $(document).ready(() => {
       }).catch(log)
 
   pc.oniceconnectionstatechange = e => log(pc.iceConnectionState)
+  let ws;
   pc.onicecandidate = event => {
+    if (ws && ws.readyState === WebSocket.OPEN) {
+      ws.send(JSON.stringify({type: 'candidate', candidate: event.candidate ? event.candidate.toJSON() : undefined}))
+    }
     if (event.candidate === null) {
       $('#localSessionDescription').val(btoa(JSON.stringify(pc.localDescription)))
     }
   }
   let el;
+  let sessionId;
   pc.ontrack = function (event) {
-    el = document.createElement(event.track.kind);
+    // The echoed audio and video share a stream, a single element plays both in sync
+    if (el) {
+      return
+    }
+    el = document.createElement('video');
     el.srcObject = event.streams[0];
     el.autoplay = true;
     el.controls = true;
@@ -44,31 +48,66 @@ $(document).ready(() => {
     }
   }
 
+  // trickleSession exchanges the offer, answer and ICE candidates over a WebSocket
+  // as they become available instead of waiting for ICE gathering to complete
+  window.trickleSession = () => {
+    let scheme = location.protocol === 'https:' ? 'wss://' : 'ws://'
+    ws = new WebSocket(scheme + location.host + '/webrtc/ws')
+    ws.onopen = () => ws.send(JSON.stringify({type: 'offer', description: pc.localDescription}))
+    ws.onmessage = event => {
+      let msg = JSON.parse(event.data)
+      switch (msg.type) {
+        case 'answer':
+          sessionId = msg.id
+          log('session ' + sessionId + ' opened over WebSocket')
+          stats.start(sessionId)
+          pc.setRemoteDescription(new RTCSessionDescription(msg.description)).catch(log)
+          break
+        case 'candidate':
+          if (msg.candidate) {
+            pc.addIceCandidate(msg.candidate).catch(log)
+          }
+          break
+        case 'error':
+          alert(msg.error.message)
+          break
+      }
+    }
+    ws.onclose = () => log('signaling closed')
+  }
+
   window.closeSession = () => {
     success = () => {
       $('#remoteSessionDescription').val("");
     }
     fail = (err) => {
-      alert(err.responseText)
+      alert(err.responseJSON ? err.responseJSON.message : err.responseText)
     }
+    stats.stop();
     pc.close();
     el.srcObject.getTracks().forEach(function(track) {
       track.stop();
     });
     el.remove();
-    el.getTracks().forEach(function(track) {
-      track.stop();
-    });
-    $.post("/webrtc/close").done(success).fail(fail)
+    if (ws) {
+      // The server closes the session along with its signaling socket
+      ws.close()
+      ws = undefined
+      return success()
+    }
+    $.post("/webrtc/close?id=" + encodeURIComponent(sessionId)).done(success).fail(fail)
   }
 
   window.sendSession = () => {
     let sessionData = $('#localSessionDescription').val();
     success = (data) => {
-      $('#remoteSessionDescription').val(data);
+      sessionId = data.id;
+      log('session ' + sessionId + ' opened');
+      stats.start(sessionId);
+      $('#remoteSessionDescription').val(data.description);
     }
     fail = (err) => {
-      alert(err.responseText)
+      alert(err.responseJSON ? err.responseJSON.message : err.responseText)
     }
     $.post("/webrtc/open", sessionData).done(success).fail(fail);
   }
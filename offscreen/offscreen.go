@@ -0,0 +1,83 @@
+// Package offscreen renders OpenGL without a window: its windows draw to an
+// offscreen buffer, which works on machines without a display nor a GPU. The
+// GL programs use one when they are run with -headless, or when GLFW cannot
+// open a window.
+package offscreen
+
+import (
+	"log"
+	"unsafe"
+)
+
+// glContext is an OpenGL context rendering to an offscreen buffer
+type glContext interface {
+	makeCurrent() error
+	swapBuffers()
+	// procAddress returns the address of an OpenGL function, or nil
+	procAddress(name string) unsafe.Pointer
+	destroy()
+}
+
+// Window has the methods of a GLFW window the GL programs render with. Its
+// framebuffer is the offscreen buffer of its context, of a fixed size, and it
+// never gets any input.
+type Window struct {
+	context       glContext
+	width, height int
+	shouldClose   bool
+}
+
+// NewWindow creates an offscreen window of width x height pixels
+func NewWindow(width, height int) (*Window, error) {
+	context, err := newContext(width, height)
+	if err != nil {
+		return nil, err
+	}
+	return &Window{context: context, width: width, height: height}, nil
+}
+
+// Fallback returns an offscreen window of width x height pixels when headless
+// is set or when initGLFW fails, typically because there is no display. It
+// returns nil when initGLFW succeeded and the program opens a GLFW window.
+func Fallback(headless bool, initGLFW func() error, width, height int) (*Window, error) {
+	if !headless {
+		err := initGLFW()
+		if err == nil {
+			return nil, nil
+		}
+		log.Printf("could not initialize GLFW, rendering offscreen: %v\n", err)
+	}
+	return NewWindow(width, height)
+}
+
+// ProcAddress returns the address of an OpenGL function of the context, or
+// nil. The programs load OpenGL with gl.InitWithProcAddrFunc(w.ProcAddress).
+func (w *Window) ProcAddress(name string) unsafe.Pointer {
+	return w.context.procAddress(name)
+}
+
+func (w *Window) GetFramebufferSize() (width, height int) {
+	return w.width, w.height
+}
+
+func (w *Window) Destroy() {
+	w.context.destroy()
+}
+
+func (w *Window) MakeContextCurrent() {
+	if err := w.context.makeCurrent(); err != nil {
+		panic(err)
+	}
+}
+
+func (w *Window) SetShouldClose(shouldClose bool) {
+	w.shouldClose = shouldClose
+}
+
+func (w *Window) ShouldClose() bool {
+	return w.shouldClose
+}
+
+func (w *Window) SwapBuffers() {
+	w.context.swapBuffers()
+}
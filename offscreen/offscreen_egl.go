@@ -0,0 +1,135 @@
+//go:build linux
+// +build linux
+
+package offscreen
+
+/*
+#cgo LDFLAGS: -lEGL
+#include <stdlib.h>
+#include <EGL/egl.h>
+#include <EGL/eglext.h>
+
+// surfacelessDisplay returns the display of the Mesa surfaceless platform,
+// which renders without any window system, or EGL_NO_DISPLAY when it is not
+// available
+static EGLDisplay surfacelessDisplay() {
+	PFNEGLGETPLATFORMDISPLAYEXTPROC getPlatformDisplay =
+		(PFNEGLGETPLATFORMDISPLAYEXTPROC)eglGetProcAddress("eglGetPlatformDisplayEXT");
+	if (getPlatformDisplay == NULL) {
+		return EGL_NO_DISPLAY;
+	}
+	return getPlatformDisplay(EGL_PLATFORM_SURFACELESS_MESA, EGL_DEFAULT_DISPLAY, NULL);
+}
+
+static EGLDisplay defaultDisplay() {
+	return eglGetDisplay(EGL_DEFAULT_DISPLAY);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// eglContext renders to an EGL pbuffer. Mesa falls back to its llvmpipe
+// software renderer on machines without a GPU.
+type eglContext struct {
+	display C.EGLDisplay
+	surface C.EGLSurface
+	context C.EGLContext
+}
+
+// newContext creates a context rendering to a pbuffer of width x height
+// pixels. It asks for an OpenGL 3.3 core profile, like the GLFW windows on
+// darwin, and settles for any version the driver has otherwise.
+func newContext(width, height int) (glContext, error) {
+	// cgo turns EGLDisplay into an uintptr, EGL_NO_DISPLAY is 0
+	c := &eglContext{display: C.surfacelessDisplay()}
+	if c.display == 0 {
+		c.display = C.defaultDisplay()
+	}
+	if c.display == 0 {
+		return nil, fmt.Errorf("no EGL display")
+	}
+	var major, minor C.EGLint
+	if C.eglInitialize(c.display, &major, &minor) == C.EGL_FALSE {
+		return nil, eglError("eglInitialize")
+	}
+	if C.eglBindAPI(C.EGL_OPENGL_API) == C.EGL_FALSE {
+		c.destroy()
+		return nil, eglError("eglBindAPI")
+	}
+
+	configAttribs := []C.EGLint{
+		C.EGL_SURFACE_TYPE, C.EGL_PBUFFER_BIT,
+		C.EGL_RENDERABLE_TYPE, C.EGL_OPENGL_BIT,
+		C.EGL_RED_SIZE, 8,
+		C.EGL_GREEN_SIZE, 8,
+		C.EGL_BLUE_SIZE, 8,
+		C.EGL_ALPHA_SIZE, 8,
+		C.EGL_DEPTH_SIZE, 24,
+		C.EGL_STENCIL_SIZE, 8,
+		C.EGL_NONE,
+	}
+	var config C.EGLConfig
+	var configs C.EGLint
+	if C.eglChooseConfig(c.display, &configAttribs[0], &config, 1, &configs) == C.EGL_FALSE || configs == 0 {
+		c.destroy()
+		return nil, eglError("eglChooseConfig")
+	}
+
+	surfaceAttribs := []C.EGLint{C.EGL_WIDTH, C.EGLint(width), C.EGL_HEIGHT, C.EGLint(height), C.EGL_NONE}
+	if c.surface = C.eglCreatePbufferSurface(c.display, config, &surfaceAttribs[0]); c.surface == nil {
+		c.destroy()
+		return nil, eglError("eglCreatePbufferSurface")
+	}
+
+	contextAttribs := []C.EGLint{
+		C.EGL_CONTEXT_MAJOR_VERSION, 3,
+		C.EGL_CONTEXT_MINOR_VERSION, 3,
+		C.EGL_CONTEXT_OPENGL_PROFILE_MASK, C.EGL_CONTEXT_OPENGL_CORE_PROFILE_BIT,
+		C.EGL_NONE,
+	}
+	if c.context = C.eglCreateContext(c.display, config, nil, &contextAttribs[0]); c.context == nil {
+		c.context = C.eglCreateContext(c.display, config, nil, nil)
+	}
+	if c.context == nil {
+		c.destroy()
+		return nil, eglError("eglCreateContext")
+	}
+	return c, nil
+}
+
+func (c *eglContext) makeCurrent() error {
+	if C.eglMakeCurrent(c.display, c.surface, c.surface, c.context) == C.EGL_FALSE {
+		return eglError("eglMakeCurrent")
+	}
+	return nil
+}
+
+func (c *eglContext) swapBuffers() {
+	C.eglSwapBuffers(c.display, c.surface)
+}
+
+func (c *eglContext) procAddress(name string) unsafe.Pointer {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	return unsafe.Pointer(C.eglGetProcAddress(cname))
+}
+
+func (c *eglContext) destroy() {
+	C.eglMakeCurrent(c.display, nil, nil, nil)
+	if c.context != nil {
+		C.eglDestroyContext(c.display, c.context)
+	}
+	if c.surface != nil {
+		C.eglDestroySurface(c.display, c.surface)
+	}
+	C.eglTerminate(c.display)
+}
+
+// eglError returns the error of the EGL call fn, which just failed
+func eglError(fn string) error {
+	return fmt.Errorf("%s failed: EGL error %#x", fn, int(C.eglGetError()))
+}
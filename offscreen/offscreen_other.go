@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package offscreen
+
+import "errors"
+
+// newContext fails, headless rendering uses EGL which is only wired up on
+// Linux
+func newContext(width, height int) (glContext, error) {
+	return nil, errors.New("headless rendering is only supported on Linux")
+}
@@ -0,0 +1,54 @@
+package offscreen
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-gl/gl/all-core/gl"
+)
+
+// TestFallback checks that a program falls back to an offscreen window when
+// GLFW cannot be initialized, as on a machine without a display, and that the
+// window renders
+func TestFallback(t *testing.T) {
+	noDisplay := func() error { return errors.New("X11: The DISPLAY environment variable is missing") }
+	window, err := Fallback(false, noDisplay, 64, 48)
+	if err != nil {
+		t.Skipf("no offscreen rendering on this machine: %v", err)
+	}
+	defer window.Destroy()
+
+	window.MakeContextCurrent()
+	if err := gl.InitWithProcAddrFunc(window.ProcAddress); err != nil {
+		t.Fatal(err)
+	}
+	if w, h := window.GetFramebufferSize(); w != 64 || h != 48 {
+		t.Errorf("framebuffer is %dx%d, expected 64x48", w, h)
+	}
+	gl.ClearColor(1, 0.5, 0, 1)
+	gl.Clear(gl.COLOR_BUFFER_BIT)
+	pix := make([]byte, 4)
+	gl.ReadPixels(10, 10, 1, 1, gl.RGBA, gl.UNSIGNED_BYTE, gl.Ptr(pix))
+	if pix[0] != 255 || pix[1] < 126 || pix[1] > 129 || pix[2] != 0 {
+		t.Errorf("read back %v, expected the clear color", pix)
+	}
+	window.SwapBuffers()
+}
+
+// TestFallbackWithDisplay checks that no offscreen window is created when GLFW
+// is initialized, and that -headless does not initialize GLFW
+func TestFallbackWithDisplay(t *testing.T) {
+	window, err := Fallback(false, func() error { return nil }, 64, 48)
+	if window != nil || err != nil {
+		t.Errorf("Fallback returned %v, %v with a display, expected nothing", window, err)
+	}
+
+	window, err = Fallback(true, func() error {
+		t.Error("GLFW initialized with -headless")
+		return nil
+	}, 64, 48)
+	if err != nil {
+		t.Skipf("no offscreen rendering on this machine: %v", err)
+	}
+	window.Destroy()
+}
@@ -2,14 +2,13 @@ package main
 
 import (
 	"fmt"
-	"github.com/go-gl/glfw/v3.3/glfw"
 	"path/filepath"
 )
 
 type Drawer interface {
 	LoadTexture(prog uint32) error
 	LoadProgram(prog uint32) error
-	DrawScene(vao uint32, window *glfw.Window, program uint32)
+	DrawScene(vao uint32, program uint32)
 }
 
 func NewDrawer(file string) (Drawer, error) {
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"github.com/go-gl/glfw/v3.3/glfw"
 	"image"
 	"image/draw"
 	_ "image/png"
@@ -90,7 +89,7 @@ func (i *ImgDrawer) LoadProgram(prog uint32) error {
 	return nil
 }
 
-func (i *ImgDrawer) DrawScene(vao uint32, window *glfw.Window, program uint32) {
+func (i *ImgDrawer) DrawScene(vao uint32, program uint32) {
 	gl.Clear(gl.COLOR_BUFFER_BIT | gl.DEPTH_BUFFER_BIT)
 	gl.UseProgram(program)
 
@@ -98,7 +97,4 @@ func (i *ImgDrawer) DrawScene(vao uint32, window *glfw.Window, program uint32) {
 	gl.BindTexture(gl.TEXTURE_2D, i.texID)
 	gl.BindVertexArray(vao)
 	gl.DrawArrays(gl.TRIANGLES, 0, int32(len(rectangleVertices)/3))
-
-	glfw.PollEvents()
-	window.SwapBuffers()
 }
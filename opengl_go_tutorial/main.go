@@ -1,12 +1,16 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"image"
 	"log"
 	"runtime"
 
 	"github.com/go-gl/gl/v4.1-core/gl"
 	"github.com/go-gl/glfw/v3.3/glfw"
+	"github.com/jtestard/tinygo-webrtc/framedump"
+	"github.com/jtestard/tinygo-webrtc/glcapture"
 	"github.com/pkg/errors"
 )
 
@@ -37,8 +41,20 @@ var (
 func main() {
 	runtime.LockOSThread()
 
+	dumpOptions := framedump.Flags(flag.CommandLine)
+	flag.Parse()
+	dumper, err := framedump.New(*dumpOptions)
+	checkNoError(err)
+	defer dumper.Close()
+
 	window := initGlfw()
 	defer glfw.Terminate()
+	// F12 saves a screenshot
+	window.SetKeyCallback(func(w *glfw.Window, key glfw.Key, scancode int, action glfw.Action, mods glfw.ModifierKey) {
+		if key == glfw.KeyF12 && action == glfw.Press {
+			dumper.RequestScreenshot()
+		}
+	})
 	drawer, err := NewDrawer("profile.png")
 	// drawer, err := NewDrawer("output.ivf")
 	checkNoError(err)
@@ -46,8 +62,16 @@ func main() {
 	vao := makeVao(rectangleVertices, rectangleTexCoords)
 	err = drawer.LoadTexture(program)
 	checkNoError(err)
-	for !window.ShouldClose() {
-		drawer.DrawScene(vao, window, program)
+	for !window.ShouldClose() && !dumper.Done() {
+		drawer.DrawScene(vao, program)
+		err = dumper.Capture(func() image.Image {
+			w, h := window.GetFramebufferSize()
+			return glcapture.CaptureSync(0, w, h)
+		})
+		checkNoError(err)
+
+		glfw.PollEvents()
+		window.SwapBuffers()
 	}
 }
 
@@ -79,6 +103,8 @@ func initGlfw() *glfw.Window {
 func initOpenGL(drawer Drawer) uint32 {
 	err := gl.Init()
 	checkNoError(err)
+	// The frames are dumped through glcapture, which has its own bindings
+	checkNoError(glcapture.Init(nil))
 	version := gl.GoStr(gl.GetString(gl.VERSION))
 	log.Println("OpenGL version", version)
 
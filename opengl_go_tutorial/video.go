@@ -2,7 +2,6 @@ package main
 
 import (
 	"github.com/go-gl/gl/v4.1-core/gl"
-	"github.com/go-gl/glfw/v3.3/glfw"
 	"github.com/hysios/go-ffmpeg-player/player"
 )
 
@@ -108,7 +107,7 @@ func (v *VideoDrawer) LoadProgram(prog uint32) error {
 	return nil
 }
 
-func (v *VideoDrawer) DrawScene(vao uint32, window *glfw.Window, program uint32) {
+func (v *VideoDrawer) DrawScene(vao uint32, program uint32) {
 	gl.Clear(gl.COLOR_BUFFER_BIT | gl.DEPTH_BUFFER_BIT)
 	gl.UseProgram(program)
 
@@ -116,9 +115,6 @@ func (v *VideoDrawer) DrawScene(vao uint32, window *glfw.Window, program uint32)
 	gl.BindTexture(gl.TEXTURE_2D, v.texID)
 	gl.BindVertexArray(vao)
 	gl.DrawArrays(gl.TRIANGLES, 0, int32(len(rectangleVertices)/3))
-
-	glfw.PollEvents()
-	window.SwapBuffers()
 }
 
 func (v *VideoDrawer) playVideo() {
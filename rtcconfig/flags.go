@@ -0,0 +1,76 @@
+package rtcconfig
+
+import (
+	"fmt"
+	"strings"
+)
+
+// listFlag is a comma separated list of strings, setting it replaces the list
+type listFlag []string
+
+func (f *listFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(value string) error {
+	*f = splitList(value)
+	return nil
+}
+
+// iceServersFlag is a comma separated list of ICE server URLs, each URL is a
+// server of its own
+type iceServersFlag []ICEServer
+
+func (f *iceServersFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	var urls []string
+	for _, s := range *f {
+		urls = append(urls, s.URLs...)
+	}
+	return strings.Join(urls, ",")
+}
+
+func (f *iceServersFlag) Set(value string) error {
+	*f = []ICEServer{}
+	for _, url := range splitList(value) {
+		*f = append(*f, ICEServer{URLs: []string{url}})
+	}
+	return nil
+}
+
+// portRangeFlag sets the UDP port range of a configuration from <min>-<max>
+type portRangeFlag Config
+
+func (f *portRangeFlag) String() string {
+	if f == nil || f.UDPPortMin == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", f.UDPPortMin, f.UDPPortMax)
+}
+
+func (f *portRangeFlag) Set(value string) error {
+	if value == "" {
+		f.UDPPortMin, f.UDPPortMax = 0, 0
+		return nil
+	}
+	if _, err := fmt.Sscanf(value, "%d-%d", &f.UDPPortMin, &f.UDPPortMax); err != nil {
+		return fmt.Errorf("invalid port range %q, expected <min>-<max>", value)
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,279 @@
+// Package rtcconfig holds the network settings shared by the WebRTC servers:
+// the address they listen on, the ICE servers, the UDP ports and the NAT
+// mapping of their host candidates. The settings are read from a JSON file
+// and overridden by command line flags, and the part the browser needs is
+// served to it so that both ends use the same ICE servers.
+package rtcconfig
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// DefaultSTUNServer is used when neither the file nor the flags list ICE servers
+const DefaultSTUNServer = "stun:stun.l.google.com:19302"
+
+// ICEServer is a STUN or TURN server. TURN servers need a username and a
+// credential.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// Config is the network configuration of a server. The JSON file uses the
+// field names of the tags, for instance:
+//
+//	{
+//	    "listen": ":8000",
+//	    "iceServers": [{"urls": ["turn:turn.lab:3478"], "username": "lab", "credential": "secret"}],
+//	    "udpMuxPort": 50000,
+//	    "nat1To1IPs": ["203.0.113.4"]
+//	}
+type Config struct {
+	// Listen is the address the HTTP server listens on
+	Listen     string      `json:"listen"`
+	ICEServers []ICEServer `json:"iceServers"`
+	// UDPPortMin and UDPPortMax bound the ports of the ICE candidates, both
+	// are 0 to let the system pick any port
+	UDPPortMin uint16 `json:"udpPortMin"`
+	UDPPortMax uint16 `json:"udpPortMax"`
+	// UDPMuxPort, when not 0, is the single UDP port the ICE traffic of every
+	// session goes through. It replaces the port range.
+	UDPMuxPort int `json:"udpMuxPort"`
+	// TCPMuxPort, when not 0, is the TCP port on which ICE-TCP is accepted
+	// for every session, for peers that cannot use UDP
+	TCPMuxPort int `json:"tcpMuxPort"`
+	// NAT1To1IPs replace the IP of the host candidates, when the server runs
+	// behind a 1:1 NAT such as a cloud instance public IP
+	NAT1To1IPs []string `json:"nat1To1IPs"`
+	// HostOnly disables STUN and TURN on both ends, only host candidates are
+	// gathered. It suits networks where the peers reach each other directly
+	// and STUN servers are unreachable.
+	HostOnly bool `json:"hostOnly"`
+
+	// udpMux and tcpMux are shared by every session once Open was called
+	udpMux ice.UDPMux
+	tcpMux ice.TCPMux
+}
+
+// Default returns the configuration used without file nor flags
+func Default() *Config {
+	return &Config{
+		Listen:     ":8000",
+		ICEServers: []ICEServer{{URLs: []string{DefaultSTUNServer}}},
+	}
+}
+
+// Flags registers the configuration flags on fs. The returned function must
+// be called once fs is parsed, it loads the file given by -config and applies
+// the flags set on top of it.
+func Flags(fs *flag.FlagSet) func() (*Config, error) {
+	c := Default()
+	path := fs.String("config", "", "JSON configuration file, the flags below override it")
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address the HTTP server listens on")
+	fs.Var((*iceServersFlag)(&c.ICEServers), "ice-servers", "comma separated list of STUN and TURN server URLs")
+	turnUsername := fs.String("turn-username", "", "username of the TURN servers given by -ice-servers")
+	turnCredential := fs.String("turn-credential", "", "credential of the TURN servers given by -ice-servers")
+	fs.Var((*portRangeFlag)(c), "udp-ports", "range of the UDP ports of the ICE candidates, as <min>-<max>")
+	fs.IntVar(&c.UDPMuxPort, "udp-mux-port", c.UDPMuxPort, "single UDP port shared by the ICE traffic of every session")
+	fs.IntVar(&c.TCPMuxPort, "tcp-mux-port", c.TCPMuxPort, "TCP port accepting ICE-TCP for every session")
+	fs.Var((*listFlag)(&c.NAT1To1IPs), "nat-ips", "comma separated list of public IPs replacing the host candidate IPs (1:1 NAT)")
+	fs.BoolVar(&c.HostOnly, "host-only", c.HostOnly, "gather host candidates only, without any STUN or TURN server")
+
+	return func() (*Config, error) {
+		// Parsing the file overwrites the values of the flags, set them again
+		// so that they take precedence
+		set := map[string]string{}
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = f.Value.String() })
+		if *path != "" {
+			if err := c.load(*path); err != nil {
+				return nil, err
+			}
+		}
+		for name, value := range set {
+			if err := fs.Set(name, value); err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := set["ice-servers"]; ok {
+			for i := range c.ICEServers {
+				if isTURN(c.ICEServers[i]) {
+					c.ICEServers[i].Username, c.ICEServers[i].Credential = *turnUsername, *turnCredential
+				}
+			}
+		}
+		return c, c.validate()
+	}
+}
+
+// load reads the JSON file at path into c, the fields it lacks keep their
+// value
+func (c *Config) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("invalid configuration %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if (c.UDPPortMin == 0) != (c.UDPPortMax == 0) || c.UDPPortMin > c.UDPPortMax {
+		return fmt.Errorf("invalid UDP port range %d-%d", c.UDPPortMin, c.UDPPortMax)
+	}
+	if c.UDPMuxPort != 0 && c.UDPPortMin != 0 {
+		return errors.New("the UDP port range and the UDP mux port are exclusive")
+	}
+	for _, port := range []int{c.UDPMuxPort, c.TCPMuxPort} {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	for _, ip := range c.NAT1To1IPs {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid NAT IP %q", ip)
+		}
+	}
+	for _, s := range c.ICEServers {
+		if len(s.URLs) == 0 {
+			return errors.New("ICE server without URL")
+		}
+		if isTURN(s) && (s.Username == "" || s.Credential == "") {
+			return fmt.Errorf("TURN server %s needs a username and a credential", strings.Join(s.URLs, ","))
+		}
+	}
+	return nil
+}
+
+// iceServers returns the ICE servers the peers use, none in host only mode
+func (c *Config) iceServers() []ICEServer {
+	if c.HostOnly {
+		return []ICEServer{}
+	}
+	return c.ICEServers
+}
+
+// Configuration returns the peer connection configuration of the server
+func (c *Config) Configuration() webrtc.Configuration {
+	config := webrtc.Configuration{}
+	for _, s := range c.iceServers() {
+		server := webrtc.ICEServer{URLs: s.URLs}
+		if s.Username != "" {
+			server.Username, server.Credential, server.CredentialType = s.Username, s.Credential, webrtc.ICECredentialTypePassword
+		}
+		config.ICEServers = append(config.ICEServers, server)
+	}
+	return config
+}
+
+// Open listens on the UDP and TCP mux ports, when they are set. It must be
+// called before peer connections are created.
+func (c *Config) Open() error {
+	if c.UDPMuxPort != 0 {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: c.UDPMuxPort})
+		if err != nil {
+			return err
+		}
+		c.udpMux = webrtc.NewICEUDPMux(nil, conn)
+	}
+	if c.TCPMuxPort != 0 {
+		listener, err := net.Listen("tcp4", ":"+strconv.Itoa(c.TCPMuxPort))
+		if err != nil {
+			c.Close()
+			return err
+		}
+		c.tcpMux = webrtc.NewICETCPMux(nil, listener, tcpReadBufferSize)
+	}
+	return nil
+}
+
+// tcpReadBufferSize is the number of packets buffered per ICE-TCP connection
+const tcpReadBufferSize = 8
+
+// Close closes the mux ports
+func (c *Config) Close() error {
+	var err error
+	if c.udpMux != nil {
+		err = c.udpMux.Close()
+	}
+	if c.tcpMux != nil {
+		if closeErr := c.tcpMux.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	c.udpMux, c.tcpMux = nil, nil
+	return err
+}
+
+// SettingEngine returns the Pion settings applying the ports and the NAT
+// mapping
+func (c *Config) SettingEngine() (webrtc.SettingEngine, error) {
+	s := webrtc.SettingEngine{}
+	if c.udpMux != nil || c.tcpMux != nil {
+		// The mux ports are bound to IPv4 only
+		networkTypes := []webrtc.NetworkType{}
+		if c.udpMux != nil {
+			s.SetICEUDPMux(c.udpMux)
+			networkTypes = append(networkTypes, webrtc.NetworkTypeUDP4)
+		}
+		if c.tcpMux != nil {
+			s.SetICETCPMux(c.tcpMux)
+			networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4)
+		}
+		s.SetNetworkTypes(networkTypes)
+	}
+	if c.UDPPortMin != 0 {
+		if err := s.SetEphemeralUDPPortRange(c.UDPPortMin, c.UDPPortMax); err != nil {
+			return s, err
+		}
+	}
+	if len(c.NAT1To1IPs) > 0 {
+		s.SetNAT1To1IPs(c.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+	return s, nil
+}
+
+// NewPeerConnection creates a peer connection with the codecs of mediaEngine
+// and the network settings of c. Candidates are gathered once the local
+// description is set and passed to OnICECandidate as they come, signaling that
+// sends them within the description must wait for GatheringCompletePromise.
+func (c *Config) NewPeerConnection(mediaEngine *webrtc.MediaEngine) (*webrtc.PeerConnection, error) {
+	settingEngine, err := c.SettingEngine()
+	if err != nil {
+		return nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(settingEngine))
+	return api.NewPeerConnection(c.Configuration())
+}
+
+// Frontend is the part of the configuration the browser needs, in the format
+// of the RTCPeerConnection constructor
+type Frontend struct {
+	ICEServers []ICEServer `json:"iceServers"`
+}
+
+// Frontend returns the configuration to hand to the browser
+func (c *Config) Frontend() Frontend {
+	return Frontend{ICEServers: c.iceServers()}
+}
+
+func isTURN(s ICEServer) bool {
+	for _, u := range s.URLs {
+		if strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package rtcconfig
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestFlags checks that the flags override the configuration file, which
+// overrides the defaults
+func TestFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtcconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	file := `{"listen": ":9000", "udpPortMin": 50000, "udpPortMax": 50100, "iceServers": [{"urls": ["stun:stun.lab"]}]}`
+	if err = ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	load := Flags(fs)
+	args := []string{"-config", path, "-ice-servers", "turn:turn.lab:3478,stun:stun.lab", "-turn-username", "lab", "-turn-credential", "secret", "-nat-ips", "203.0.113.4"}
+	if err = fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	c, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Config{
+		Listen: ":9000",
+		ICEServers: []ICEServer{
+			{URLs: []string{"turn:turn.lab:3478"}, Username: "lab", Credential: "secret"},
+			{URLs: []string{"stun:stun.lab"}},
+		},
+		UDPPortMin: 50000,
+		UDPPortMax: 50100,
+		NAT1To1IPs: []string{"203.0.113.4"},
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("configuration is %+v, expected %+v", c, expected)
+	}
+	if servers := c.Configuration().ICEServers; len(servers) != 2 || servers[0].Username != "lab" {
+		t.Errorf("peer connection ICE servers are %+v, expected the TURN server with its credentials and the STUN server", servers)
+	}
+
+	c.HostOnly = true
+	if servers := c.Frontend().ICEServers; len(servers) != 0 {
+		t.Errorf("host only frontend has ICE servers %+v", servers)
+	}
+}
+
+// TestInvalid checks that inconsistent settings are refused
+func TestInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		{"-udp-ports", "50100-50000"},
+		{"-udp-ports", "50000"},
+		{"-nat-ips", "not an IP"},
+		{"-ice-servers", "turn:turn.lab:3478"},
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		load := Flags(fs)
+		if err := fs.Parse(args); err != nil {
+			continue
+		}
+		if _, err := load(); err == nil {
+			t.Errorf("%v was accepted", args)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package rtcsession
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// skippedCodecs are the formats of an offer that carry no media of their own:
+// retransmissions, redundancy and forward error correction
+var skippedCodecs = map[string]bool{"rtx": true, "red": true, "ulpfec": true, "flexfec-03": true}
+
+// OfferedCodecs returns the codecs of kind the offer proposes, in its order of
+// preference and with its payload types. Registering them in the media engine
+// of the session makes the answer use the payload types of the browser.
+func OfferedCodecs(offer webrtc.SessionDescription, kind webrtc.RTPCodecType) ([]webrtc.RTPCodecParameters, error) {
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return nil, ErrBadOffer(err)
+	}
+
+	var offered []webrtc.RTPCodecParameters
+	seen := map[webrtc.PayloadType]bool{}
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != kind.String() {
+			continue
+		}
+		// Payload types are only defined within their media section
+		section := &sdp.SessionDescription{MediaDescriptions: []*sdp.MediaDescription{media}}
+		for _, format := range media.MediaName.Formats {
+			payloadType, err := strconv.ParseUint(format, 10, 8)
+			if err != nil || seen[webrtc.PayloadType(payloadType)] {
+				continue
+			}
+			codec, err := section.GetCodecForPayloadType(uint8(payloadType))
+			if err != nil || skippedCodecs[strings.ToLower(codec.Name)] {
+				continue
+			}
+			seen[webrtc.PayloadType(payloadType)] = true
+			offered = append(offered, newCodecParameters(kind, codec))
+		}
+	}
+	return offered, nil
+}
+
+func newCodecParameters(kind webrtc.RTPCodecType, codec sdp.Codec) webrtc.RTPCodecParameters {
+	capability := webrtc.RTPCodecCapability{
+		MimeType:    kind.String() + "/" + codec.Name,
+		ClockRate:   codec.ClockRate,
+		SDPFmtpLine: codec.Fmtp,
+	}
+	if channels, err := strconv.ParseUint(codec.EncodingParameters, 10, 16); err == nil {
+		capability.Channels = uint16(channels)
+	}
+	for _, feedback := range codec.RTCPFeedback {
+		fields := strings.SplitN(feedback, " ", 2)
+		fb := webrtc.RTCPFeedback{Type: fields[0]}
+		if len(fields) == 2 {
+			fb.Parameter = fields[1]
+		}
+		capability.RTCPFeedback = append(capability.RTCPFeedback, fb)
+	}
+	return webrtc.RTPCodecParameters{RTPCodecCapability: capability, PayloadType: webrtc.PayloadType(codec.PayloadType)}
+}
+
+// CodecName returns the name of the codec of mimeType, its subtype
+func CodecName(mimeType string) string {
+	if i := strings.IndexByte(mimeType, '/'); i >= 0 {
+		return mimeType[i+1:]
+	}
+	return mimeType
+}
+
+// newPayloader returns the RTP payloader of the codec of mimeType, or nil when
+// samples of the codec cannot be packetized
+func newPayloader(mimeType string) rtp.Payloader {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return &codecs.VP8Payloader{}
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return &codecs.H264Payloader{}
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return &codecs.OpusPayloader{}
+	}
+	return nil
+}
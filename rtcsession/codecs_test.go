@@ -0,0 +1,64 @@
+package rtcsession
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// testOffer is the part of a browser offer that lists codecs, with a
+// retransmission format to skip
+const testOffer = `v=0
+o=- 0 0 IN IP4 127.0.0.1
+s=-
+t=0 0
+m=audio 9 UDP/TLS/RTP/SAVPF 111
+c=IN IP4 0.0.0.0
+a=mid:0
+a=rtpmap:111 opus/48000/2
+a=fmtp:111 minptime=10;useinbandfec=1
+m=video 9 UDP/TLS/RTP/SAVPF 96 97 102
+c=IN IP4 0.0.0.0
+a=mid:1
+a=rtpmap:96 VP8/90000
+a=rtcp-fb:96 nack pli
+a=rtpmap:97 rtx/90000
+a=fmtp:97 apt=96
+a=rtpmap:102 H264/90000
+a=fmtp:102 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f
+`
+
+// TestOfferedCodecs checks that the codecs of an offer are listed by kind in
+// their order, with the payload types and parameters of the offer
+func TestOfferedCodecs(t *testing.T) {
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: testOffer}
+	video, err := OfferedCodecs(offer, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(video) != 2 {
+		t.Fatalf("got %d video codecs, expected VP8 and H264: %+v", len(video), video)
+	}
+	vp8, h264 := video[0], video[1]
+	if vp8.MimeType != webrtc.MimeTypeVP8 || vp8.PayloadType != 96 || vp8.ClockRate != 90000 {
+		t.Errorf("first codec is %+v, expected VP8 on payload type 96", vp8)
+	}
+	if len(vp8.RTCPFeedback) != 1 || vp8.RTCPFeedback[0] != (webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}) {
+		t.Errorf("VP8 feedback is %+v, expected nack pli", vp8.RTCPFeedback)
+	}
+	if h264.MimeType != webrtc.MimeTypeH264 || h264.PayloadType != 102 || h264.SDPFmtpLine == "" {
+		t.Errorf("second codec is %+v, expected H264 on payload type 102 with its parameters", h264)
+	}
+
+	audio, err := OfferedCodecs(offer, webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(audio) != 1 || audio[0].MimeType != webrtc.MimeTypeOpus || audio[0].Channels != 2 {
+		t.Errorf("audio codecs are %+v, expected stereo Opus", audio)
+	}
+
+	if _, err = OfferedCodecs(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "garbage"}, webrtc.RTPCodecTypeVideo); err == nil {
+		t.Error("an invalid offer was accepted")
+	}
+}
@@ -0,0 +1,109 @@
+package rtcsession
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Error is an error returned by the signaling handlers. It carries the HTTP
+// status and a short machine readable code that the frontend can switch on.
+// Servers create their own errors with it next to the ones below.
+type Error struct {
+	Status int
+	Code   string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorResponse is the JSON body written for every failed request
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ErrBadOffer is returned when the body of a signaling request cannot be
+// turned into an offer
+func ErrBadOffer(err error) error {
+	return &Error{Status: http.StatusBadRequest, Code: "bad_offer", Err: err}
+}
+
+// ErrUnsupportedCodec is returned when the offer does not contain a codec we can send
+func ErrUnsupportedCodec(format string, a ...interface{}) error {
+	return &Error{Status: http.StatusUnsupportedMediaType, Code: "unsupported_codec", Err: fmt.Errorf(format, a...)}
+}
+
+// ErrSourceNotFound is returned when a session asks for a source we do not broadcast
+func ErrSourceNotFound(name string) error {
+	return &Error{Status: http.StatusBadRequest, Code: "source_not_found", Err: fmt.Errorf("no source named %q", name)}
+}
+
+// ErrInvalidPort is returned when a session asks for a port the core does not have
+func ErrInvalidPort(port string, ports int) error {
+	return &Error{Status: http.StatusBadRequest, Code: "invalid_port", Err: fmt.Errorf("invalid port %q, the ports go from 0 to %d", port, ports-1)}
+}
+
+// ErrPortTaken is returned when a session asks for a port another player controls
+func ErrPortTaken(port int) error {
+	return &Error{Status: http.StatusConflict, Code: "port_taken", Err: fmt.Errorf("port %d is already taken", port)}
+}
+
+// ErrSessionNotFound is returned when closing a session that is not open
+func ErrSessionNotFound(id string) error {
+	return &Error{Status: http.StatusBadRequest, Code: "session_not_found", Err: fmt.Errorf("session %q already closed/never opened", id)}
+}
+
+// ErrSessionInProgress is returned when a signaling connection already opened a session
+func ErrSessionInProgress() error {
+	return &Error{Status: http.StatusConflict, Code: "session_in_progress", Err: errors.New("session already started on this connection")}
+}
+
+// ErrUnsupportedContentType is returned when a signaling body is not in the expected format
+func ErrUnsupportedContentType(contentType string) error {
+	return &Error{Status: http.StatusUnsupportedMediaType, Code: "unsupported_content_type", Err: fmt.Errorf("unsupported content type %q", contentType)}
+}
+
+// ErrResourceNotFound is returned when a WHIP/WHEP resource URL does not match an open session
+func ErrResourceNotFound(path string) error {
+	return &Error{Status: http.StatusNotFound, Code: "resource_not_found", Err: fmt.Errorf("no session at %s", path)}
+}
+
+// ErrMethodNotAllowed is returned when an endpoint is called with the wrong HTTP method
+func ErrMethodNotAllowed(method string) error {
+	return &Error{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Err: fmt.Errorf("method %s not allowed", method)}
+}
+
+// ErrInternal wraps failures of the WebRTC stack or of the server itself
+func ErrInternal(err error) error {
+	return &Error{Status: http.StatusInternalServerError, Code: "internal", Err: err}
+}
+
+// asError returns err as an Error, errors of another type are reported as
+// internal errors
+func asError(err error) *Error {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = ErrInternal(err).(*Error)
+	}
+	return e
+}
+
+// WriteError writes err as a JSON error body. Errors that are not an Error
+// are reported as internal errors.
+func WriteError(w http.ResponseWriter, err error) {
+	e := asError(err)
+	log.Printf("request failed (%d %s): %v\n", e.Status, e.Code, e.Err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(ErrorResponse{Code: e.Code, Message: e.Error()})
+}
@@ -0,0 +1,101 @@
+package rtcsession
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The Prometheus collectors of the servers. They are registered once, with
+// the default registry, and served by MetricsHandler.
+var (
+	sessionsActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "webrtc",
+		Name:      "sessions_active",
+		Help:      "Sessions currently open.",
+	})
+	sessionsOpened = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "webrtc",
+		Name:      "sessions_opened_total",
+		Help:      "Session open requests, by outcome: ok or the error code returned to the client.",
+	}, []string{"outcome"})
+	sessionsClosed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "webrtc",
+		Name:      "sessions_closed_total",
+		Help:      "Closed sessions, by outcome: ok or error.",
+	}, []string{"outcome"})
+	signalingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "webrtc",
+		Name:      "signaling_duration_seconds",
+		Help:      "Time from the offer of the browser to the answer sent back, by signaling endpoint.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"endpoint"})
+	iceStateChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "webrtc",
+		Name:      "ice_connection_state_changes_total",
+		Help:      "ICE connection state transitions, by new state.",
+	}, []string{"state"})
+	rtpPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "webrtc",
+		Name:      "rtp_packets_total",
+		Help:      "RTP packets received from (inbound) or sent to (outbound) the browsers.",
+	}, []string{"direction", "kind"})
+	rtpBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "webrtc",
+		Name:      "rtp_bytes_total",
+		Help:      "RTP payload bytes received from (inbound) or sent to (outbound) the browsers.",
+	}, []string{"direction", "kind"})
+	streamLateness = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "webrtc",
+		Name:      "stream_lateness_seconds",
+		Help:      "How late streamed samples were sent compared to their presentation time.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 10),
+	}, []string{"broadcast", "kind"})
+)
+
+func init() {
+	prometheus.MustRegister(sessionsActive, sessionsOpened, sessionsClosed, signalingDuration,
+		iceStateChanges, rtpPackets, rtpBytes, streamLateness)
+}
+
+// MetricsHandler serves the metrics of the server in the Prometheus text
+// format, on /metrics
+var MetricsHandler = promhttp.Handler()
+
+// ObserveOpen counts an open request on endpoint that started at start and
+// failed with err, or succeeded if it is nil. The signaling latency is only
+// observed for sessions that opened.
+func ObserveOpen(endpoint string, start time.Time, err error) {
+	if err != nil {
+		sessionsOpened.WithLabelValues(asError(err).Code).Inc()
+		return
+	}
+	sessionsOpened.WithLabelValues("ok").Inc()
+	signalingDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+}
+
+// CountICEState counts a transition of the ICE connection of a session to
+// state
+func CountICEState(state webrtc.ICEConnectionState) {
+	iceStateChanges.WithLabelValues(state.String()).Inc()
+}
+
+// CountInboundRTP counts packet, read from a track of the given kind sent by
+// a browser. Packets sent on a Track are counted as they are written.
+func CountInboundRTP(kind webrtc.RTPCodecType, packet *rtp.Packet) {
+	countRTP("inbound", kind, packet)
+}
+
+func countRTP(direction string, kind webrtc.RTPCodecType, packet *rtp.Packet) {
+	rtpPackets.WithLabelValues(direction, kind.String()).Inc()
+	rtpBytes.WithLabelValues(direction, kind.String()).Add(float64(len(packet.Payload)))
+}
+
+// ObserveLateness records that a sample of the given kind of broadcast was
+// sent late after its presentation time
+func ObserveLateness(broadcast string, kind webrtc.RTPCodecType, late time.Duration) {
+	streamLateness.WithLabelValues(broadcast, kind.String()).Observe(late.Seconds())
+}
@@ -0,0 +1,39 @@
+package rtcsession
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestMetrics checks that the active sessions follow the registry and that
+// open requests are counted by the error code returned to the client
+func TestMetrics(t *testing.T) {
+	active := testutil.ToFloat64(sessionsActive)
+	sessions := NewRegistry()
+	s := sessions.Add(&Session{ID: "metrics"})
+	sessions.Add(s)
+	if got := testutil.ToFloat64(sessionsActive); got != active+1 {
+		t.Errorf("%v sessions active after adding one, expected %v", got, active+1)
+	}
+	sessions.Remove(s.ID)
+	sessions.Remove(s.ID)
+	if got := testutil.ToFloat64(sessionsActive); got != active {
+		t.Errorf("%v sessions active after removing it, expected %v", got, active)
+	}
+
+	for outcome, err := range map[string]error{
+		"ok":               nil,
+		"bad_offer":        ErrBadOffer(errors.New("no SDP")),
+		"internal":         errors.New("failed"),
+		"source_not_found": ErrSourceNotFound("nope"),
+	} {
+		before := testutil.ToFloat64(sessionsOpened.WithLabelValues(outcome))
+		ObserveOpen("test", time.Now(), err)
+		if got := testutil.ToFloat64(sessionsOpened.WithLabelValues(outcome)); got != before+1 {
+			t.Errorf("%s: counted %v opens, expected %v", outcome, got, before+1)
+		}
+	}
+}
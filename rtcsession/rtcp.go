@@ -0,0 +1,312 @@
+package rtcsession
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// rtpOutboundMTU is the size of the RTP packets samples are split into, the
+// one Pion uses
+const rtpOutboundMTU = 1200
+
+// senderReportInterval is the time between two sender reports about the
+// tracks of a session
+const senderReportInterval = time.Second
+
+// TrackStats describes how the browser receives a track we send it, from its
+// last RTCP reception report about the track
+type TrackStats struct {
+	SSRC         uint32  `json:"ssrc"`
+	Kind         string  `json:"kind"`
+	Codec        string  `json:"codec"`
+	FractionLost float64 `json:"fractionLost"`
+	PacketsLost  uint32  `json:"packetsLost"`
+	// PacketsReceived is the number of packets the browser received, up to
+	// the highest sequence number it reported
+	PacketsReceived uint32 `json:"packetsReceived"`
+	// Jitter is the interarrival jitter, in seconds
+	Jitter float64 `json:"jitter"`
+	// RoundTripTime is computed from the report, in seconds. It is only known
+	// once the browser received one of our sender reports.
+	RoundTripTime float64 `json:"roundTripTime,omitempty"`
+}
+
+// trackReport is what the session knows of a track it sends: what its sender
+// reports need from the packets written, and the last reception report of the
+// browser about it
+type trackReport struct {
+	stats     TrackStats
+	clockRate uint32
+
+	// packets and octets count the RTP packets and payload bytes written, as
+	// sender reports require
+	packets uint32
+	octets  uint32
+	// timestamp is the RTP timestamp of the last packet written, at sentAt
+	timestamp uint32
+	sentAt    time.Time
+	// firstSequence is the sequence number of the first packet written
+	firstSequence uint16
+}
+
+// RTCPStats writes the sender reports about the tracks a session sends and
+// keeps what the browser sends back in RTCP: its feedback and reception
+// reports about those tracks, and its sender reports about its own tracks.
+type RTCPStats struct {
+	lock  sync.Mutex
+	nacks uint64
+	plis  uint64
+	firs  uint64
+	// tracks are the tracks sent, by SSRC
+	tracks map[uint32]*trackReport
+	// remote holds the packet counts of the last sender report of each track
+	// the browser sends, by SSRC
+	remote map[uint32]uint32
+	// roundTripTime is the last round trip time computed, in seconds
+	roundTripTime float64
+	reporting     bool
+}
+
+func newRTCPStats() *RTCPStats {
+	return &RTCPStats{tracks: map[uint32]*trackReport{}, remote: map[uint32]uint32{}}
+}
+
+// Track is a track sent by a session whose packets are described in the
+// sender reports of the session. Samples and packets must be written through
+// it rather than through the webrtc.TrackLocalStaticRTP it wraps.
+type Track struct {
+	*webrtc.TrackLocalStaticRTP
+	stats  *RTCPStats
+	report *trackReport
+	// packetizer splits samples into packets, it is nil when the codec of the
+	// track has no payloader and only packets can be written
+	packetizer rtp.Packetizer
+}
+
+// errNoPayloader is returned when a sample is written on a track whose codec
+// cannot be packetized
+var errNoPayloader = errors.New("no RTP payloader for the codec of the track")
+
+// AddTrack adds track to the peer connection of the session and returns it
+// wrapped so that its sender reports are written. The RTCP the browser sends
+// about the track must be read with ReadRTCP from the returned sender.
+func (s *Session) AddTrack(track *webrtc.TrackLocalStaticRTP) (*Track, *webrtc.RTPSender, error) {
+	sender, err := s.PeerConnection.AddTrack(track)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The SSRC of the track is the one of its sender, Pion writes it in every
+	// packet of the track
+	ssrc := uint32(sender.GetParameters().Encodings[0].SSRC)
+	codec := track.Codec()
+	report := &trackReport{
+		stats:     TrackStats{SSRC: ssrc, Kind: track.Kind().String(), Codec: CodecName(codec.MimeType)},
+		clockRate: codec.ClockRate,
+	}
+	t := &Track{TrackLocalStaticRTP: track, stats: s.RTCP, report: report}
+	if payloader := newPayloader(codec.MimeType); payloader != nil {
+		// The payload type is set by Pion to the one negotiated
+		t.packetizer = rtp.NewPacketizer(rtpOutboundMTU, 0, ssrc, payloader, rtp.NewRandomSequencer(), codec.ClockRate)
+	}
+
+	s.RTCP.lock.Lock()
+	defer s.RTCP.lock.Unlock()
+	s.RTCP.tracks[ssrc] = report
+	if !s.RTCP.reporting {
+		s.RTCP.reporting = true
+		go s.RTCP.writeSenderReports(s.PeerConnection)
+	}
+	return t, sender, nil
+}
+
+// SSRC returns the SSRC of the packets of the track
+func (t *Track) SSRC() uint32 {
+	return t.report.stats.SSRC
+}
+
+// WriteSample packetizes the sample and writes its packets. The RTP timestamp
+// of the next sample is the one of this sample plus its duration.
+func (t *Track) WriteSample(sample media.Sample) error {
+	if t.packetizer == nil {
+		return errNoPayloader
+	}
+	samples := uint32(math.Round(sample.Duration.Seconds() * float64(t.report.clockRate)))
+	for _, packet := range t.packetizer.Packetize(sample.Data, samples) {
+		if err := t.WriteRTP(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteRTP writes packet, records it for the next sender report and counts it
+// in the metrics
+func (t *Track) WriteRTP(packet *rtp.Packet) error {
+	if err := t.TrackLocalStaticRTP.WriteRTP(packet); err != nil {
+		return err
+	}
+	t.stats.sent(t.report, packet, time.Now())
+	countRTP("outbound", t.Kind(), packet)
+	return nil
+}
+
+// sent records packet, written on the track of r at now
+func (s *RTCPStats) sent(r *trackReport, packet *rtp.Packet, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if r.packets == 0 {
+		r.firstSequence = packet.SequenceNumber
+	}
+	r.packets++
+	r.octets += uint32(len(packet.Payload))
+	r.timestamp, r.sentAt = packet.Timestamp, now
+}
+
+// writeSenderReports sends a sender report about every track that started
+// every senderReportInterval until the peer connection is closed. The
+// reception reports that follow them give the round trip time.
+func (s *RTCPStats) writeSenderReports(pc *webrtc.PeerConnection) {
+	ticker := time.NewTicker(senderReportInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+		if packets := s.senderReports(time.Now()); len(packets) > 0 {
+			if err := pc.WriteRTCP(packets); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// senderReports returns the sender reports about the tracks that started, as
+// of now
+func (s *RTCPStats) senderReports(now time.Time) []rtcp.Packet {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var packets []rtcp.Packet
+	for ssrc, r := range s.tracks {
+		if r.packets == 0 {
+			continue
+		}
+		// The RTP clock of the track kept running since its last packet
+		elapsed := uint32(now.Sub(r.sentAt).Seconds() * float64(r.clockRate))
+		packets = append(packets, &rtcp.SenderReport{
+			SSRC:        ssrc,
+			NTPTime:     ntpTime(now),
+			RTPTime:     r.timestamp + elapsed,
+			PacketCount: r.packets,
+			OctetCount:  r.octets,
+		})
+	}
+	return packets
+}
+
+// rtcpReader is the sender or the receiver of a track
+type rtcpReader interface {
+	ReadRTCP() ([]rtcp.Packet, interceptor.Attributes, error)
+}
+
+// ReadRTCP records the RTCP read from r until it is closed, and hands every
+// packet to handle unless it is nil
+func (s *RTCPStats) ReadRTCP(r rtcpReader, handle func(rtcp.Packet)) {
+	for {
+		packets, _, err := r.ReadRTCP()
+		if err != nil {
+			return
+		}
+		s.Record(packets, time.Now())
+		if handle == nil {
+			continue
+		}
+		for _, packet := range packets {
+			handle(packet)
+		}
+	}
+}
+
+// Record counts the feedback and keeps the reports in packets, received at now
+func (s *RTCPStats) Record(packets []rtcp.Packet, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, packet := range packets {
+		switch p := packet.(type) {
+		case *rtcp.TransportLayerNack:
+			s.nacks++
+		case *rtcp.PictureLossIndication:
+			s.plis++
+		case *rtcp.FullIntraRequest:
+			s.firs++
+		case *rtcp.ReceiverReport:
+			s.recordReports(p.Reports, now)
+		case *rtcp.SenderReport:
+			s.remote[p.SSRC] = p.PacketCount
+			s.recordReports(p.Reports, now)
+		}
+	}
+}
+
+func (s *RTCPStats) recordReports(reports []rtcp.ReceptionReport, now time.Time) {
+	for _, report := range reports {
+		r, ok := s.tracks[report.SSRC]
+		if !ok {
+			continue
+		}
+		t := &r.stats
+		t.FractionLost = float64(report.FractionLost) / 256
+		t.PacketsLost = report.TotalLost
+		if expected := int64(report.LastSequenceNumber) - int64(r.firstSequence) + 1; r.packets > 0 && expected > int64(report.TotalLost) {
+			t.PacketsReceived = uint32(expected - int64(report.TotalLost))
+		}
+		if r.clockRate != 0 {
+			t.Jitter = float64(report.Jitter) / float64(r.clockRate)
+		}
+		if report.LastSenderReport != 0 {
+			// The LSR, DLSR and the middle of the NTP time are all in 1/65536
+			// seconds, the difference is the time spent on the network
+			t.RoundTripTime = float64(ntpMiddle(now)-report.LastSenderReport-report.Delay) / 65536
+			s.roundTripTime = t.RoundTripTime
+		}
+	}
+}
+
+// snapshot fills the RTCP part of stats, tracks are listed video first
+func (s *RTCPStats) snapshot(stats *Stats) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats.NACKs, stats.PLIs, stats.FIRs = s.nacks, s.plis, s.firs
+	stats.RoundTripTime = s.roundTripTime
+	stats.Tracks = []TrackStats{}
+	for _, r := range s.tracks {
+		stats.Tracks = append(stats.Tracks, r.stats)
+		stats.PacketsSent += uint64(r.stats.PacketsReceived) + uint64(r.stats.PacketsLost)
+	}
+	sort.Slice(stats.Tracks, func(i, j int) bool { return stats.Tracks[i].Kind > stats.Tracks[j].Kind })
+	for _, packets := range s.remote {
+		stats.PacketsReceived += uint64(packets)
+	}
+}
+
+// ntpTime returns the 64 bit NTP timestamp of t: seconds since 1900 in 32.32
+// fixed point
+func ntpTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix()) + 2208988800
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// ntpMiddle returns the middle 32 bits of the NTP timestamp of t, the format
+// of the RTCP round trip time fields
+func ntpMiddle(t time.Time) uint32 {
+	return uint32(ntpTime(t) >> 16)
+}
@@ -0,0 +1,79 @@
+package rtcsession
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// TestRTCPStats writes packets on a track across a sequence number wrap, and
+// checks the sender report about them and the stats taken from the reception
+// report answering it
+func TestRTCPStats(t *testing.T) {
+	s := newRTCPStats()
+	r := &trackReport{stats: TrackStats{SSRC: 1, Kind: "video", Codec: "VP8"}, clockRate: 90000}
+	s.tracks[1] = r
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		packet := &rtp.Packet{Header: rtp.Header{SSRC: 1, SequenceNumber: uint16(65530 + i), Timestamp: uint32(3000 * i)}, Payload: make([]byte, 100)}
+		s.sent(r, packet, start.Add(time.Duration(i)*time.Second/30))
+	}
+
+	// The report is written 100ms after the last packet, the RTP clock ran on
+	last := start.Add(9 * time.Second / 30)
+	reportTime := last.Add(100 * time.Millisecond)
+	packets := s.senderReports(reportTime)
+	if len(packets) != 1 {
+		t.Fatalf("got %d sender reports, expected 1", len(packets))
+	}
+	sr := packets[0].(*rtcp.SenderReport)
+	if sr.SSRC != 1 || sr.PacketCount != 10 || sr.OctetCount != 1000 {
+		t.Errorf("sender report is %+v, expected 10 packets and 1000 octets of SSRC 1", sr)
+	}
+	if sr.RTPTime != 27000+9000 {
+		t.Errorf("sender report RTP time is %d, expected %d", sr.RTPTime, 27000+9000)
+	}
+
+	// The browser held the report for 40ms before answering, 60ms after it
+	// was sent: the round trip took 20ms
+	s.Record([]rtcp.Packet{
+		&rtcp.ReceiverReport{Reports: []rtcp.ReceptionReport{{
+			SSRC:               1,
+			FractionLost:       64,
+			TotalLost:          1,
+			LastSequenceNumber: 1<<16 | 3,
+			Jitter:             900,
+			LastSenderReport:   uint32(sr.NTPTime >> 16),
+			Delay:              40 * 65536 / 1000,
+		}}},
+		&rtcp.SenderReport{SSRC: 2, PacketCount: 42},
+		&rtcp.PictureLossIndication{MediaSSRC: 1},
+		&rtcp.TransportLayerNack{MediaSSRC: 1},
+	}, reportTime.Add(60*time.Millisecond))
+
+	stats := Stats{}
+	s.snapshot(&stats)
+	if len(stats.Tracks) != 1 {
+		t.Fatalf("got %d tracks, expected 1", len(stats.Tracks))
+	}
+	track := stats.Tracks[0]
+	if track.PacketsReceived != 9 || track.PacketsLost != 1 || track.FractionLost != 0.25 {
+		t.Errorf("track stats are %+v, expected 9 packets received, 1 lost, a quarter lost", track)
+	}
+	if track.Jitter != 0.01 {
+		t.Errorf("jitter is %fs, expected 10ms", track.Jitter)
+	}
+	if math.Abs(track.RoundTripTime-0.02) > 0.001 || stats.RoundTripTime != track.RoundTripTime {
+		t.Errorf("round trip time is %fs (session %fs), expected 20ms", track.RoundTripTime, stats.RoundTripTime)
+	}
+	if stats.PacketsSent != 10 || stats.PacketsReceived != 42 {
+		t.Errorf("session sent %d packets and received %d, expected 10 and 42", stats.PacketsSent, stats.PacketsReceived)
+	}
+	if stats.PLIs != 1 || stats.NACKs != 1 || stats.FIRs != 0 {
+		t.Errorf("got %d PLI, %d NACK and %d FIR, expected 1, 1 and 0", stats.PLIs, stats.NACKs, stats.FIRs)
+	}
+}
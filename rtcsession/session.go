@@ -0,0 +1,210 @@
+// Package rtcsession keeps track of the WebRTC sessions of the servers: the
+// registry their signaling endpoints open and close sessions through, the
+// WebSocket signaling they share, the statistics served on /webrtc/stats and
+// the Prometheus metrics served on /metrics. Sessions whose ICE connection is
+// lost are closed without waiting for the client, and Serve closes every
+// session when the server shuts down.
+package rtcsession
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// DisconnectedTimeout is how long the ICE connection of a session may stay
+// disconnected before the session is closed
+const DisconnectedTimeout = 15 * time.Second
+
+// Session is a peer connection opened by a browser
+type Session struct {
+	// ID is the random identifier the client closes the session with
+	ID             string
+	PeerConnection *webrtc.PeerConnection
+	// RTCP writes the sender reports of the session and keeps the RTCP the
+	// browser sends
+	RTCP *RTCPStats
+
+	registry *Registry
+	// ctx is done once the session is closed, cancel ends it
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock    sync.Mutex
+	onClose []func()
+	// disconnected closes the session once its ICE connection stayed
+	// disconnected for DisconnectedTimeout, it is nil while connected
+	disconnected *time.Timer
+}
+
+// Context returns a context that is done once the session is closed. The
+// goroutines serving the session stop with it.
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// OnClose calls f when the session is closed, before its peer connection is.
+// Servers finalise what they keep per session there, such as recordings.
+func (s *Session) OnClose(f func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.onClose = append(s.onClose, f)
+}
+
+// Close runs the OnClose hooks of the session, ends its context and closes its
+// peer connection. The outcome is counted in the metrics.
+func (s *Session) Close() (err error) {
+	defer func() {
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+		}
+		sessionsClosed.WithLabelValues(outcome).Inc()
+	}()
+
+	s.lock.Lock()
+	onClose := s.onClose
+	s.onClose = nil
+	s.stopDisconnectedTimer()
+	s.lock.Unlock()
+	for _, f := range onClose {
+		f()
+	}
+	s.cancel()
+	return s.PeerConnection.Close()
+}
+
+// Abort ends the context of a session that failed to open and closes its peer
+// connection. Unlike Close it neither runs the hooks nor counts the session.
+func (s *Session) Abort() {
+	s.cancel()
+	s.PeerConnection.Close()
+}
+
+// WatchICE follows the ICE connection of the session, servers call it from
+// their ICE connection state handler. A failed session is closed at once, a
+// disconnected one once it did not reconnect within DisconnectedTimeout. The
+// transition is counted in the metrics.
+func (s *Session) WatchICE(state webrtc.ICEConnectionState) {
+	CountICEState(state)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch state {
+	case webrtc.ICEConnectionStateFailed:
+		s.stopDisconnectedTimer()
+		// The handler runs on the ICE agent, which closing waits for
+		go s.registry.CloseSession(s.ID, "ICE failed")
+	case webrtc.ICEConnectionStateDisconnected:
+		if s.disconnected == nil {
+			s.disconnected = time.AfterFunc(DisconnectedTimeout, func() {
+				s.registry.CloseSession(s.ID, "ICE disconnected for "+DisconnectedTimeout.String())
+			})
+		}
+	default:
+		s.stopDisconnectedTimer()
+	}
+}
+
+// stopDisconnectedTimer is called with the lock held
+func (s *Session) stopDisconnectedTimer() {
+	if s.disconnected != nil {
+		s.disconnected.Stop()
+		s.disconnected = nil
+	}
+}
+
+// Registry keeps track of every open session by its server-issued ID
+type Registry struct {
+	lock     sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{sessions: map[string]*Session{}}
+}
+
+// New creates a session for peerConnection, it is registered with Add once
+// its signaling succeeded
+func (r *Registry) New(peerConnection *webrtc.PeerConnection) *Session {
+	s := &Session{ID: newSessionID(), PeerConnection: peerConnection, RTCP: newRTCPStats(), registry: r}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// Add registers the session under its ID
+func (r *Registry) Add(s *Session) *Session {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.sessions[s.ID]; !ok {
+		sessionsActive.Inc()
+	}
+	r.sessions[s.ID] = s
+	return s
+}
+
+// Get returns the session called id, or nil if there is none
+func (r *Registry) Get(id string) *Session {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.sessions[id]
+}
+
+// Remove unregisters the session and returns it, or nil if it was unknown
+func (r *Registry) Remove(id string) *Session {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	s, ok := r.sessions[id]
+	if !ok {
+		return nil
+	}
+	delete(r.sessions, id)
+	sessionsActive.Dec()
+	return s
+}
+
+// CloseSession removes the session called id and closes it, logging reason.
+// It does nothing when the session is already gone.
+func (r *Registry) CloseSession(id, reason string) {
+	s := r.Remove(id)
+	if s == nil {
+		return
+	}
+	if err := s.Close(); err != nil {
+		log.Printf("session %s: could not close: %v\n", id, err)
+	}
+	log.Printf("session %s closed: %s\n", id, reason)
+}
+
+// List returns every open session
+func (r *Registry) List() []*Session {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	list := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		list = append(list, s)
+	}
+	return list
+}
+
+// Len returns the number of open sessions
+func (r *Registry) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.sessions)
+}
+
+// newSessionID returns a random 128 bit hex encoded identifier
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,38 @@
+package rtcsession
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// TestWatchICE checks that a session whose ICE connection reconnects is kept
+// and that one whose ICE connection failed is closed and unregistered
+func TestWatchICE(t *testing.T) {
+	sessions := NewRegistry()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sessions.Add(sessions.New(pc))
+	closed := make(chan struct{})
+	s.OnClose(func() { close(closed) })
+
+	s.WatchICE(webrtc.ICEConnectionStateDisconnected)
+	s.WatchICE(webrtc.ICEConnectionStateConnected)
+	if s.disconnected != nil {
+		t.Error("disconnected timer still running after reconnecting")
+	}
+
+	s.WatchICE(webrtc.ICEConnectionStateFailed)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed after ICE failed")
+	}
+	<-s.Context().Done()
+	if sessions.Get(s.ID) != nil {
+		t.Error("closed session still registered")
+	}
+}
@@ -0,0 +1,51 @@
+package rtcsession
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is how long the requests in flight are given to complete
+// once the server is asked to stop
+const shutdownTimeout = 5 * time.Second
+
+// Serve serves handler on addr, or http.DefaultServeMux when it is nil, until
+// the process receives SIGINT or SIGTERM. The server then stops accepting
+// requests, waits up to shutdownTimeout for the ones in flight and closes
+// every session of sessions. It returns nil once shut down this way.
+func Serve(addr string, handler http.Handler, sessions *Registry) error {
+	server := &http.Server{Addr: addr, Handler: handler}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case sig := <-signals:
+		log.Printf("received %s, shutting down\n", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if serveErr := <-served; !errors.Is(serveErr, http.ErrServerClosed) && err == nil {
+		err = serveErr
+	}
+	for _, s := range sessions.List() {
+		sessions.CloseSession(s.ID, "server shutting down")
+	}
+	return err
+}
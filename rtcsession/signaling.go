@@ -0,0 +1,158 @@
+package rtcsession
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+var upgrader = websocket.Upgrader{}
+
+// SignalMessage is exchanged in both directions on the signaling WebSocket.
+// The browser sends an "offer" followed by its "candidate"s, the server
+// replies with an "answer" and its own "candidate"s as they are gathered. A
+// "candidate" without candidate signals the end of gathering.
+type SignalMessage struct {
+	Type        string                     `json:"type"`
+	ID          string                     `json:"id,omitempty"`
+	Description *webrtc.SessionDescription `json:"description,omitempty"`
+	Candidate   *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+	Error       *ErrorResponse             `json:"error,omitempty"`
+}
+
+// OpenFunc opens and registers the session of an offer received on a
+// signaling WebSocket. The peer connection must trickle its candidates to
+// onCandidate, which sends them once the answer went out.
+type OpenFunc func(offer webrtc.SessionDescription, onCandidate func(*webrtc.ICECandidate)) (*Session, webrtc.SessionDescription, error)
+
+// signalConn serializes writes on a signaling WebSocket and holds back local
+// candidates until the answer went out, a browser rejects candidates that
+// arrive before its remote description.
+type signalConn struct {
+	conn *websocket.Conn
+
+	lock     sync.Mutex
+	answered bool
+	pending  []SignalMessage
+}
+
+func (c *signalConn) send(msg SignalMessage) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.conn.WriteJSON(msg)
+}
+
+func (c *signalConn) sendError(err error) error {
+	e := asError(err)
+	log.Printf("signaling failed (%s): %v\n", e.Code, e.Err)
+	return c.send(SignalMessage{Type: "error", Error: &ErrorResponse{Code: e.Code, Message: e.Error()}})
+}
+
+// sendAnswer sends the answer and flushes the candidates gathered meanwhile
+func (c *signalConn) sendAnswer(id string, answer webrtc.SessionDescription) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.conn.WriteJSON(SignalMessage{Type: "answer", ID: id, Description: &answer}); err != nil {
+		return err
+	}
+	c.answered = true
+	for _, msg := range c.pending {
+		if err := c.conn.WriteJSON(msg); err != nil {
+			return err
+		}
+	}
+	c.pending = nil
+	return nil
+}
+
+// onICECandidate is registered on the peer connection to trickle local candidates
+func (c *signalConn) onICECandidate(candidate *webrtc.ICECandidate) {
+	msg := SignalMessage{Type: "candidate"}
+	if candidate != nil {
+		init := candidate.ToJSON()
+		msg.Candidate = &init
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.answered {
+		c.pending = append(c.pending, msg)
+		return
+	}
+	if err := c.conn.WriteJSON(msg); err != nil {
+		log.Printf("could not send ICE candidate: %v\n", err)
+	}
+}
+
+// WebSocketHandler serves the signaling WebSocket of the servers, on
+// /webrtc/ws. It opens a session through open for the offer of the browser
+// and exchanges the candidates of both ends as they are gathered. The session
+// lives as long as the WebSocket, closing the socket closes the session.
+func WebSocketHandler(sessions *Registry, open OpenFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade already replied to the client
+			log.Printf("could not upgrade signaling connection: %v\n", err)
+			return
+		}
+		defer conn.Close()
+		c := &signalConn{conn: conn}
+
+		var s *Session
+		defer func() {
+			if s != nil {
+				sessions.CloseSession(s.ID, "signaling connection closed")
+			}
+		}()
+
+		for {
+			msg := SignalMessage{}
+			if err := conn.ReadJSON(&msg); err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					log.Printf("signaling connection closed: %v\n", err)
+				}
+				return
+			}
+
+			switch msg.Type {
+			case "offer":
+				if s != nil {
+					err = ErrSessionInProgress()
+				} else if msg.Description == nil {
+					err = ErrBadOffer(errors.New("offer without description"))
+				} else {
+					start := time.Now()
+					var answer webrtc.SessionDescription
+					if s, answer, err = open(*msg.Description, c.onICECandidate); err == nil {
+						err = c.sendAnswer(s.ID, answer)
+						fmt.Printf("session %s: answer sent over WebSocket\n", s.ID)
+					}
+					ObserveOpen("websocket", start, err)
+				}
+			case "candidate":
+				if s == nil {
+					err = ErrBadOffer(errors.New("candidate received before offer"))
+				} else if msg.Candidate != nil {
+					if err = s.PeerConnection.AddICECandidate(*msg.Candidate); err != nil {
+						err = ErrBadOffer(err)
+					}
+				}
+			default:
+				err = ErrBadOffer(fmt.Errorf("unknown message type %q", msg.Type))
+			}
+
+			if err != nil {
+				if sendErr := c.sendError(err); sendErr != nil {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package rtcsession
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// openTrickle answers offer on a peer connection trickling its candidates
+func openTrickle(sessions *Registry) OpenFunc {
+	return func(offer webrtc.SessionDescription, onCandidate func(*webrtc.ICECandidate)) (*Session, webrtc.SessionDescription, error) {
+		pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			return nil, webrtc.SessionDescription{}, err
+		}
+		pc.OnICECandidate(onCandidate)
+		if err = pc.SetRemoteDescription(offer); err != nil {
+			return nil, webrtc.SessionDescription{}, ErrBadOffer(err)
+		}
+		answer, err := pc.CreateAnswer(nil)
+		if err != nil {
+			return nil, answer, err
+		}
+		if err = pc.SetLocalDescription(answer); err != nil {
+			return nil, answer, err
+		}
+		return sessions.Add(sessions.New(pc)), answer, nil
+	}
+}
+
+// TestWebSocketTrickle sends an offer over the signaling WebSocket and checks
+// that the answer comes without candidates, which follow it as candidate
+// messages up to the end of gathering. Closing the socket closes the session.
+func TestWebSocketTrickle(t *testing.T) {
+	sessions := NewRegistry()
+	server := httptest.NewServer(WebSocketHandler(sessions, openTrickle(sessions)))
+	defer server.Close()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = conn.WriteJSON(SignalMessage{Type: "offer", Description: &offer}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	answer := SignalMessage{}
+	if err = conn.ReadJSON(&answer); err != nil {
+		t.Fatal(err)
+	}
+	if answer.Type != "answer" || answer.Description == nil {
+		t.Fatalf("received %+v, expected an answer", answer)
+	}
+	if strings.Contains(answer.Description.SDP, "a=candidate:") {
+		t.Error("the answer lists candidates, they should be trickled")
+	}
+	if sessions.Len() != 1 {
+		t.Fatalf("%d sessions open, expected 1", sessions.Len())
+	}
+
+	candidates := 0
+	for {
+		msg := SignalMessage{}
+		if err = conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("after %d candidates: %v", candidates, err)
+		}
+		if msg.Type != "candidate" {
+			t.Fatalf("received %+v, expected a candidate", msg)
+		}
+		if msg.Candidate == nil {
+			break
+		}
+		candidates++
+	}
+	if candidates == 0 {
+		t.Error("gathering ended without any candidate")
+	}
+
+	// A second offer on the same connection is refused
+	if err = conn.WriteJSON(SignalMessage{Type: "offer", Description: &offer}); err != nil {
+		t.Fatal(err)
+	}
+	msg := SignalMessage{}
+	if err = conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "error" || msg.Error == nil || msg.Error.Code != "session_in_progress" {
+		t.Errorf("received %+v, expected a session_in_progress error", msg)
+	}
+
+	conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); sessions.Len() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the session was not closed along with its WebSocket")
+		}
+	}
+}
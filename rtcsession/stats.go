@@ -0,0 +1,113 @@
+package rtcsession
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Stats is returned by /webrtc/stats for every session. Byte counts are those
+// of the ICE transport of the session, packet counts and round trip time are
+// what the browser reported in RTCP, along with its feedback.
+type Stats struct {
+	ID            string `json:"id"`
+	BytesSent     uint64 `json:"bytesSent"`
+	BytesReceived uint64 `json:"bytesReceived"`
+	// PacketsSent is the number of packets of our tracks the browser
+	// accounted for in its reception reports, received or lost
+	PacketsSent uint64 `json:"packetsSent"`
+	// PacketsReceived is the number of packets the browser sent according to
+	// its sender reports
+	PacketsReceived uint64 `json:"packetsReceived"`
+	NACKs           uint64 `json:"nackCount"`
+	PLIs            uint64 `json:"pliCount"`
+	FIRs            uint64 `json:"firCount"`
+	// RoundTripTime is the last round trip time computed from a reception
+	// report, in seconds
+	RoundTripTime float64        `json:"roundTripTime"`
+	Tracks        []TrackStats   `json:"tracks"`
+	CandidatePair *CandidatePair `json:"candidatePair,omitempty"`
+}
+
+// CandidatePair is the ICE candidate pair a session selected
+type CandidatePair struct {
+	Local  Candidate `json:"local"`
+	Remote Candidate `json:"remote"`
+}
+
+// Candidate is one end of a candidate pair
+type Candidate struct {
+	Type     string `json:"type"`
+	Protocol string `json:"protocol"`
+	IP       string `json:"ip"`
+	Port     int32  `json:"port"`
+}
+
+// Stats collects the statistics of the session from the GetStats report of
+// Pion and from the RTCP the browser sent
+func (s *Session) Stats() Stats {
+	stats := Stats{ID: s.ID}
+	s.RTCP.snapshot(&stats)
+
+	report := s.PeerConnection.GetStats()
+	for _, stat := range report {
+		switch stat := stat.(type) {
+		case webrtc.TransportStats:
+			stats.BytesSent, stats.BytesReceived = stat.BytesSent, stat.BytesReceived
+		case webrtc.ICECandidatePairStats:
+			if !stat.Nominated || stat.State != webrtc.StatsICECandidatePairStateSucceeded {
+				continue
+			}
+			local, localOK := report[stat.LocalCandidateID].(webrtc.ICECandidateStats)
+			remote, remoteOK := report[stat.RemoteCandidateID].(webrtc.ICECandidateStats)
+			if localOK && remoteOK {
+				stats.CandidatePair = &CandidatePair{Local: newCandidate(local), Remote: newCandidate(remote)}
+			}
+		}
+	}
+	return stats
+}
+
+func newCandidate(c webrtc.ICECandidateStats) Candidate {
+	return Candidate{Type: c.CandidateType.String(), Protocol: c.Protocol, IP: c.IP, Port: c.Port}
+}
+
+// StatsHandler serves the statistics of every open session as JSON on
+// /webrtc/stats, or of the session given by ?id=<id>
+func StatsHandler(sessions *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var list []*Session
+		if id := r.URL.Query().Get("id"); id != "" {
+			s := sessions.Get(id)
+			if s == nil {
+				WriteError(w, ErrSessionNotFound(id))
+				return
+			}
+			list = []*Session{s}
+		} else {
+			list = sessions.List()
+		}
+
+		stats := []Stats{}
+		for _, s := range list {
+			stats = append(stats, s.Stats())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			log.Printf("could not send stats: %v\n", err)
+		}
+	}
+}
+
+//go:embed stats.js
+var statsScript []byte
+
+// StatsScript serves the script of the demo pages graphing /webrtc/stats, at
+// /static/stats.js
+var StatsScript = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write(statsScript)
+})
@@ -0,0 +1,94 @@
+/* eslint-env browser */
+// Polls /webrtc/stats for the open session and graphs the last minute of it
+window.stats = (() => {
+  const history = 60
+  let timer
+  let last
+  let series = {}
+
+  // graph draws the series on a canvas, scaled to its largest value
+  let graph = (canvas, lines) => {
+    let ctx = canvas.getContext('2d')
+    ctx.clearRect(0, 0, canvas.width, canvas.height)
+    let max = 0
+    lines.forEach(line => (series[line.name] || []).forEach(v => { max = Math.max(max, v) }))
+    if (max === 0) {
+      max = 1
+    }
+    lines.forEach((line, i) => {
+      let values = series[line.name] || []
+      ctx.strokeStyle = line.color
+      ctx.beginPath()
+      values.forEach((v, x) => {
+        let px = x * canvas.width / (history - 1)
+        let py = canvas.height - v * (canvas.height - 12) / max
+        x === 0 ? ctx.moveTo(px, py) : ctx.lineTo(px, py)
+      })
+      ctx.stroke()
+      ctx.fillStyle = line.color
+      ctx.fillText(line.name + ' ' + (values.length ? values[values.length - 1].toFixed(1) : '-'), 4 + i * 140, 10)
+    })
+    ctx.fillStyle = '#666'
+    ctx.fillText('max ' + max.toFixed(1), canvas.width - 70, 10)
+  }
+
+  let push = (name, value) => {
+    let values = series[name] = series[name] || []
+    values.push(value)
+    if (values.length > history) {
+      values.shift()
+    }
+  }
+
+  let update = s => {
+    let now = performance.now()
+    if (last) {
+      let seconds = (now - last.time) / 1000
+      push('kbps sent', (s.bytesSent - last.stats.bytesSent) * 8 / 1000 / seconds)
+      push('kbps received', (s.bytesReceived - last.stats.bytesReceived) * 8 / 1000 / seconds)
+    }
+    last = {time: now, stats: s}
+
+    s.tracks.forEach(t => {
+      push(t.kind + ' jitter ms', t.jitter * 1000)
+      push(t.kind + ' lost %', t.fractionLost * 100)
+    })
+    push('rtt ms', s.roundTripTime * 1000)
+
+    graph(document.getElementById('statsBitrate'), [
+      {name: 'kbps sent', color: '#1f77b4'},
+      {name: 'kbps received', color: '#ff7f0e'}
+    ])
+    graph(document.getElementById('statsLatency'), [
+      {name: 'rtt ms', color: '#2ca02c'},
+      {name: 'video jitter ms', color: '#d62728'},
+      {name: 'audio jitter ms', color: '#9467bd'}
+    ])
+    graph(document.getElementById('statsLoss'), [
+      {name: 'video lost %', color: '#d62728'},
+      {name: 'audio lost %', color: '#9467bd'}
+    ])
+
+    let pair = s.candidatePair
+    document.getElementById('statsSummary').textContent =
+      'packets sent ' + s.packetsSent + ', received ' + s.packetsReceived +
+      ' | NACK ' + s.nackCount + ', PLI ' + s.pliCount + ', FIR ' + s.firCount +
+      (pair ? ' | ' + pair.local.type + ' ' + pair.local.ip + ':' + pair.local.port +
+        ' <-> ' + pair.remote.type + ' ' + pair.remote.ip + ':' + pair.remote.port + ' (' + pair.local.protocol + ')' : '')
+  }
+
+  return {
+    // start polls the stats of the session called id every second
+    start: id => {
+      clearInterval(timer)
+      last = undefined
+      series = {}
+      timer = setInterval(() => {
+        $.getJSON('/webrtc/stats?id=' + encodeURIComponent(id))
+          .done(list => list.forEach(update))
+          .fail(() => clearInterval(timer))
+      }, 1000)
+    },
+    stop: () => clearInterval(timer)
+  }
+})()
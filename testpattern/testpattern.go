@@ -0,0 +1,135 @@
+// Package testpattern draws synthetic video frames in pure Go: colour bars, a
+// box moving across them and the frame number burned in underneath. Demos and
+// tests can stream it without any media file, and since every frame differs
+// from the previous one dropped or repeated frames are easy to see.
+package testpattern
+
+import (
+	"image"
+	"image/color"
+)
+
+// bars are the 75% colour bars, from left to right
+var bars = []color.RGBA{
+	{191, 191, 191, 255}, // white
+	{191, 191, 0, 255},   // yellow
+	{0, 191, 191, 255},   // cyan
+	{0, 191, 0, 255},     // green
+	{191, 0, 191, 255},   // magenta
+	{191, 0, 0, 255},     // red
+	{0, 0, 191, 255},     // blue
+}
+
+var (
+	white = color.RGBA{255, 255, 255, 255}
+	black = color.RGBA{16, 16, 16, 255}
+)
+
+// boxSpeed is the number of pixels the box moves per frame
+const boxSpeed = 4
+
+// digits is a 3x5 pixel font for the frame counter, each row of a digit is
+// stored in the 3 low bits of a byte
+var digits = [10][5]uint8{
+	{7, 5, 5, 5, 7},
+	{2, 6, 2, 2, 7},
+	{7, 1, 7, 4, 7},
+	{7, 1, 7, 1, 7},
+	{5, 5, 7, 1, 1},
+	{7, 4, 7, 1, 7},
+	{7, 4, 7, 5, 7},
+	{7, 1, 1, 1, 1},
+	{7, 5, 7, 5, 7},
+	{7, 5, 7, 1, 7},
+}
+
+// Generator draws the frames of the test pattern
+type Generator struct {
+	Width, Height int
+}
+
+// New returns a generator of width x height frames
+func New(width, height int) *Generator {
+	return &Generator{Width: width, Height: height}
+}
+
+// Frame draws frame n of the pattern as a 4:2:0 YCbCr image, which is the
+// raw I420 layout encoders and the GL viewers take
+func (g *Generator) Frame(n int) *image.YCbCr {
+	img := image.NewYCbCr(image.Rect(0, 0, g.Width, g.Height), image.YCbCrSubsampleRatio420)
+
+	// Bars over the top two thirds, the counter below them
+	barsHeight := g.Height * 2 / 3
+	for i, c := range bars {
+		fill(img, image.Rect(i*g.Width/len(bars), 0, (i+1)*g.Width/len(bars), barsHeight), c)
+	}
+	fill(img, image.Rect(0, barsHeight, g.Width, g.Height), black)
+
+	// The box bounces from one side to the other
+	size := g.Height / 6
+	if size < 2 {
+		size = 2
+	}
+	x := 0
+	if travel := g.Width - size; travel > 0 {
+		x = n * boxSpeed % (2 * travel)
+		if x > travel {
+			x = 2*travel - x
+		}
+	}
+	y := (barsHeight - size) / 2
+	fill(img, image.Rect(x, y, x+size, y+size), white)
+
+	g.drawCounter(img, n, barsHeight)
+	return img
+}
+
+// drawCounter writes n in the band below the bars starting at top
+func (g *Generator) drawCounter(img *image.YCbCr, n, top int) {
+	// Each pixel of the font is drawn as a square of cell pixels, a digit
+	// takes 4 cells including the space after it
+	cell := (g.Height - top) / 7
+	if cell < 1 {
+		return
+	}
+	var text []int
+	for {
+		text = append([]int{n % 10}, text...)
+		if n /= 10; n == 0 {
+			break
+		}
+	}
+
+	x0, y0 := cell, top+cell
+	for i, d := range text {
+		for row, bits := range digits[d] {
+			for col := 0; col < 3; col++ {
+				if bits&(4>>uint(col)) == 0 {
+					continue
+				}
+				x := x0 + (4*i+col)*cell
+				y := y0 + row*cell
+				fill(img, image.Rect(x, y, x+cell, y+cell), white)
+			}
+		}
+	}
+}
+
+// fill paints r in c, clipped to the image
+func fill(img *image.YCbCr, r image.Rectangle, c color.RGBA) {
+	r = r.Intersect(img.Rect)
+	if r.Empty() {
+		return
+	}
+	yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.Y[img.YOffset(x, y)] = yy
+			// Chroma samples cover 2x2 pixels, the last pixel painted sets
+			// them
+			i := img.COffset(x, y)
+			img.Cb[i] = cb
+			img.Cr[i] = cr
+		}
+	}
+}
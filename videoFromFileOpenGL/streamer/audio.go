@@ -0,0 +1,50 @@
+package main
+
+import "time"
+
+const (
+	// opusSampleRate is the clock rate of Opus in WebRTC, the audio of the
+	// core is resampled to it
+	opusSampleRate = 48000
+	// opusFrameSize is the number of samples per channel of a 20ms Opus frame
+	opusFrameSize = opusSampleRate / 50
+	// opusFrameDuration is the duration of an Opus frame, the sample duration
+	// of every audio sample sent
+	opusFrameDuration = 20 * time.Millisecond
+)
+
+// resampler converts the interleaved stereo samples of the core to 48kHz by
+// linear interpolation and cuts them into Opus frames
+type resampler struct {
+	// step is the distance between two output samples, in input samples
+	step float64
+	// pos is the position of the next output sample, between prev and the
+	// next input sample
+	pos  float64
+	prev [2]int16
+	// frame is the Opus frame being filled
+	frame []int16
+}
+
+func newResampler(inputRate float64) *resampler {
+	return &resampler{step: inputRate / opusSampleRate, frame: make([]int16, 0, 2*opusFrameSize)}
+}
+
+// push adds a stereo sample and calls emit with every Opus frame it completes.
+// The frames are not reused once emitted.
+func (r *resampler) push(left, right int16, emit func([]int16)) {
+	for ; r.pos < 1; r.pos += r.step {
+		r.frame = append(r.frame, lerp(r.prev[0], left, r.pos), lerp(r.prev[1], right, r.pos))
+		if len(r.frame) == cap(r.frame) {
+			emit(r.frame)
+			r.frame = make([]int16, 0, 2*opusFrameSize)
+		}
+	}
+	r.pos--
+	r.prev = [2]int16{left, right}
+}
+
+// lerp interpolates between a and b, t is between 0 and 1
+func lerp(a, b int16, t float64) int16 {
+	return int16(float64(a) + (float64(b)-float64(a))*t)
+}
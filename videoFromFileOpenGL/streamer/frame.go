@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"unsafe"
+)
+
+// Pixel formats of the libretro API, see RETRO_PIXEL_FORMAT in libretro.h
+const (
+	pixelFormat0RGB1555 = iota
+	pixelFormatXRGB8888
+	pixelFormatRGB565
+	// pixelFormatAuto guesses the format from the pitch of the frames
+	pixelFormatAuto = -1
+)
+
+// hwFrameBufferValid is the data a hardware rendered core passes to the refresh
+// callback, the frame is then in the framebuffer and not in memory
+const hwFrameBufferValid = ^uintptr(0)
+
+// parsePixelFormat parses the value of the -pixel-format flag
+func parsePixelFormat(name string) (int, error) {
+	switch name {
+	case "auto":
+		return pixelFormatAuto, nil
+	case "0rgb1555":
+		return pixelFormat0RGB1555, nil
+	case "xrgb8888":
+		return pixelFormatXRGB8888, nil
+	case "rgb565":
+		return pixelFormatRGB565, nil
+	}
+	return 0, fmt.Errorf("unknown pixel format %q, expected auto, 0rgb1555, xrgb8888 or rgb565", name)
+}
+
+// guessPixelFormat returns XRGB8888 for frames of 4 bytes per pixel and RGB565
+// otherwise. RGB565 is what the cores picking a 16 bit format set, 0RGB1555
+// is only used by the cores that never set one.
+func guessPixelFormat(width, pitch int) int {
+	if pitch >= width*4 {
+		return pixelFormatXRGB8888
+	}
+	return pixelFormatRGB565
+}
+
+// frameBytes returns the memory of a frame passed to the refresh callback
+func frameBytes(data unsafe.Pointer, height, pitch int) []byte {
+	n := height * pitch
+	return (*[1 << 30]byte)(data)[:n:n]
+}
+
+// convertFrame converts a frame of the core to 4:2:0 YCbCr, the input of the
+// VP8 encoder. Each chroma sample is the average of the 2x2 pixels it covers.
+func convertFrame(pix []byte, width, height, pitch, format int) *image.YCbCr {
+	img := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+	bpp := 2
+	if format == pixelFormatXRGB8888 {
+		bpp = 4
+	}
+
+	for cy := 0; cy < (height+1)/2; cy++ {
+		for cx := 0; cx < (width+1)/2; cx++ {
+			var r, g, b, n int
+			for y := 2 * cy; y < 2*cy+2 && y < height; y++ {
+				for x := 2 * cx; x < 2*cx+2 && x < width; x++ {
+					pr, pg, pb := readPixel(pix[y*pitch+x*bpp:], format)
+					img.Y[y*img.YStride+x], _, _ = color.RGBToYCbCr(pr, pg, pb)
+					r, g, b, n = r+int(pr), g+int(pg), b+int(pb), n+1
+				}
+			}
+			_, img.Cb[cy*img.CStride+cx], img.Cr[cy*img.CStride+cx] = color.RGBToYCbCr(uint8(r/n), uint8(g/n), uint8(b/n))
+		}
+	}
+	return img
+}
+
+// readPixel decodes the pixel at the start of pix
+func readPixel(pix []byte, format int) (r, g, b uint8) {
+	switch format {
+	case pixelFormatXRGB8888:
+		// Little endian 0xXXRRGGBB
+		return pix[2], pix[1], pix[0]
+	case pixelFormatRGB565:
+		v := uint16(pix[0]) | uint16(pix[1])<<8
+		g := uint8(v >> 5 & 0x3f)
+		return expand5(v >> 11), g<<2 | g>>4, expand5(v)
+	default:
+		v := uint16(pix[0]) | uint16(pix[1])<<8
+		return expand5(v >> 10), expand5(v >> 5), expand5(v)
+	}
+}
+
+// expand5 scales the 5 low bits of v to 8 bits
+func expand5(v uint16) uint8 {
+	c := uint8(v & 0x1f)
+	return c<<3 | c>>2
+}
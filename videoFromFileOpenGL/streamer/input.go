@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jtestard/tinygo-webrtc/rtcsession"
+	"github.com/pion/webrtc/v3"
+)
+
+// inputChannelLabel is the label of the data channel the page sends its input on
+const inputChannelLabel = "input"
+
+// Message types of the input protocol. Every message starts with its type and
+// numbers are little endian, see README.md.
+const (
+	// msgGamepad is the state of the pad of the player: type, timestamp
+	// (uint32 ms), buttons (uint16, bit n is the libretro joypad button n)
+	// and the left x, left y, right x and right y axes (int16)
+	msgGamepad = 0x01
+	// msgKeyboard is a key pressed or released: type, timestamp (uint32 ms),
+	// libretro key code (uint16), down (uint8, 0 or 1)
+	msgKeyboard = 0x02
+	// msgAck is sent back once the frame an input was applied to was sent:
+	// type, timestamp of the input (uint32 ms), delay between the reception
+	// of the input and the sending of the frame (uint32 µs)
+	msgAck = 0x81
+
+	gamepadMessageSize  = 15
+	keyboardMessageSize = 8
+	ackMessageSize      = 9
+
+	// maxUnsentInputs bounds the inputs waiting for their frame to be sent,
+	// the oldest are never acked past it, for instance when the core stops
+	// producing frames
+	maxUnsentInputs = 256
+)
+
+// Libretro devices and IDs the input state callback is asked for, see
+// RETRO_DEVICE in libretro.h
+const (
+	deviceJoypad       = 1
+	deviceKeyboard     = 3
+	deviceAnalog       = 5
+	deviceIDJoypadMask = 256
+	joypadButtons      = 16
+)
+
+// padState is the state of a gamepad, axes are left x, left y, right x and
+// right y
+type padState struct {
+	buttons uint16
+	axes    [4]int16
+}
+
+// ackSender is the data channel of a player, acks are sent on it
+type ackSender interface {
+	Send(data []byte) error
+}
+
+// player is a session controlling a port of the core
+type player struct {
+	port int
+	// session is the ID of the session controlling the port
+	session string
+	pad     padState
+	// keys are the keys held by the player, by libretro key code
+	keys map[uint16]bool
+	// channel is the data channel acks are sent on, nil until it is open
+	channel ackSender
+}
+
+// timedInput is an input waiting for the frame it is applied to be sent
+type timedInput struct {
+	player *player
+	// timestamp is the time the page sent the input at, on its own clock
+	timestamp uint32
+	received  time.Time
+	// frame is the index of the first frame run with the input, 0 until
+	// the core polled it
+	frame int64
+}
+
+// inputState holds the input of every player and answers the input callbacks
+// of the core. Each session controls a port, sessions joining once every port
+// is taken only watch.
+type inputState struct {
+	lock    sync.Mutex
+	players []*player
+	// pending are the inputs received since the last poll, applied are the
+	// polled ones waiting for their frame to be sent
+	pending []*timedInput
+	applied []*timedInput
+
+	// polled and polledKeys are the input the core sees until the next
+	// poll, they are only used on the main thread
+	polled     []padState
+	polledKeys map[uint16]bool
+}
+
+func newInputState(ports int) *inputState {
+	return &inputState{players: make([]*player, ports), polled: make([]padState, ports), polledKeys: map[uint16]bool{}}
+}
+
+// join gives the session called id the port until ctx is done, or the first
+// free port when port is -1. It returns nil when every port is taken, the
+// session then only watches.
+func (in *inputState) join(ctx context.Context, id string, port int) (*player, error) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	if port >= len(in.players) || port < -1 {
+		return nil, rtcsession.ErrInvalidPort(strconv.Itoa(port), len(in.players))
+	}
+	if port == -1 {
+		for i, p := range in.players {
+			if p == nil {
+				port = i
+				break
+			}
+		}
+		if port == -1 {
+			return nil, nil
+		}
+	} else if in.players[port] != nil {
+		return nil, rtcsession.ErrPortTaken(port)
+	}
+
+	p := &player{port: port, session: id, keys: map[uint16]bool{}}
+	in.players[port] = p
+	go func() {
+		<-ctx.Done()
+		in.leave(p)
+	}()
+	return p, nil
+}
+
+// portOf returns the port the session called id controls, or -1 when it only
+// watches
+func (in *inputState) portOf(id string) int {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	for _, p := range in.players {
+		if p != nil && p.session == id {
+			return p.port
+		}
+	}
+	return -1
+}
+
+// leave frees the port of p, the buttons and keys it held are released
+func (in *inputState) leave(p *player) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	in.players[p.port] = nil
+	in.pending = dropPlayer(in.pending, p)
+	in.applied = dropPlayer(in.applied, p)
+}
+
+func dropPlayer(inputs []*timedInput, p *player) []*timedInput {
+	kept := inputs[:0]
+	for _, input := range inputs {
+		if input.player != p {
+			kept = append(kept, input)
+		}
+	}
+	return kept
+}
+
+// attach reads the input p sends on channel
+func (in *inputState) attach(p *player, channel *webrtc.DataChannel) {
+	channel.OnOpen(func() {
+		in.lock.Lock()
+		p.channel = channel
+		in.lock.Unlock()
+	})
+	channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if err := in.handle(p, msg.Data); err != nil {
+			log.Printf("port %d: invalid input: %v\n", p.port, err)
+		}
+	})
+}
+
+// handle applies a message of the input protocol sent by p
+func (in *inputState) handle(p *player, data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("empty message")
+	}
+	input := &timedInput{player: p, received: time.Now()}
+	var apply func()
+
+	switch data[0] {
+	case msgGamepad:
+		if len(data) != gamepadMessageSize {
+			return fmt.Errorf("gamepad message of %d bytes", len(data))
+		}
+		pad := padState{buttons: binary.LittleEndian.Uint16(data[5:])}
+		for i := range pad.axes {
+			pad.axes[i] = int16(binary.LittleEndian.Uint16(data[7+2*i:]))
+		}
+		apply = func() { p.pad = pad }
+	case msgKeyboard:
+		if len(data) != keyboardMessageSize {
+			return fmt.Errorf("keyboard message of %d bytes", len(data))
+		}
+		code, down := binary.LittleEndian.Uint16(data[5:]), data[7] != 0
+		apply = func() {
+			if down {
+				p.keys[code] = true
+			} else {
+				delete(p.keys, code)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown message type %#x", data[0])
+	}
+	input.timestamp = binary.LittleEndian.Uint32(data[1:])
+
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	apply()
+	in.pending = append(in.pending, input)
+	return nil
+}
+
+// poll is the input poll callback of the core, frame is the index of the frame
+// being run. It takes the input the core sees until the next poll, which is
+// applied to that frame.
+func (in *inputState) poll(frame int64) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	for k := range in.polledKeys {
+		delete(in.polledKeys, k)
+	}
+	for port, p := range in.players {
+		in.polled[port] = padState{}
+		if p == nil {
+			continue
+		}
+		in.polled[port] = p.pad
+		for k := range p.keys {
+			in.polledKeys[k] = true
+		}
+	}
+	for _, input := range in.pending {
+		input.frame = frame
+	}
+	in.applied = append(in.applied, in.pending...)
+	in.pending = nil
+	if extra := len(in.applied) - maxUnsentInputs; extra > 0 {
+		in.applied = append(in.applied[:0], in.applied[extra:]...)
+	}
+}
+
+// state is the input state callback of the core
+func (in *inputState) state(port uint, device uint32, index uint, id uint) int16 {
+	switch device {
+	case deviceJoypad:
+		if port >= uint(len(in.polled)) {
+			return 0
+		}
+		if id == deviceIDJoypadMask {
+			return int16(in.polled[port].buttons)
+		}
+		if id < joypadButtons && in.polled[port].buttons&(1<<id) != 0 {
+			return 1
+		}
+	case deviceAnalog:
+		if port < uint(len(in.polled)) && index < 2 && id < 2 {
+			return in.polled[port].axes[2*index+id]
+		}
+	case deviceKeyboard:
+		// The keyboard is shared by the players
+		if in.polledKeys[uint16(id)] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// frameSent acks the inputs applied to the frames up to index, once the frame
+// was sent to the sessions. The page measures the input to photon latency
+// from them.
+func (in *inputState) frameSent(index int64) {
+	now := time.Now()
+	type ack struct {
+		channel ackSender
+		msg     []byte
+	}
+	var acks []ack
+
+	in.lock.Lock()
+	kept := in.applied[:0]
+	for _, input := range in.applied {
+		if input.frame > index {
+			kept = append(kept, input)
+			continue
+		}
+		if input.player.channel == nil {
+			continue
+		}
+		msg := make([]byte, ackMessageSize)
+		msg[0] = msgAck
+		binary.LittleEndian.PutUint32(msg[1:], input.timestamp)
+		binary.LittleEndian.PutUint32(msg[5:], uint32(now.Sub(input.received)/time.Microsecond))
+		acks = append(acks, ack{input.player.channel, msg})
+	}
+	in.applied = kept
+	in.lock.Unlock()
+
+	for _, a := range acks {
+		if err := a.channel.Send(a.msg); err != nil {
+			log.Printf("could not ack input: %v\n", err)
+		}
+	}
+}
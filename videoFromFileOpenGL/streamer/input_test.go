@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// fakeChannel keeps the acks sent to a player
+type fakeChannel struct {
+	sent [][]byte
+}
+
+func (c *fakeChannel) Send(data []byte) error {
+	c.sent = append(c.sent, data)
+	return nil
+}
+
+func gamepadMessage(timestamp uint32, buttons uint16, axes [4]int16) []byte {
+	msg := make([]byte, gamepadMessageSize)
+	msg[0] = msgGamepad
+	binary.LittleEndian.PutUint32(msg[1:], timestamp)
+	binary.LittleEndian.PutUint16(msg[5:], buttons)
+	for i, axis := range axes {
+		binary.LittleEndian.PutUint16(msg[7+2*i:], uint16(axis))
+	}
+	return msg
+}
+
+func keyboardMessage(timestamp uint32, code uint16, down bool) []byte {
+	msg := make([]byte, keyboardMessageSize)
+	msg[0] = msgKeyboard
+	binary.LittleEndian.PutUint32(msg[1:], timestamp)
+	binary.LittleEndian.PutUint16(msg[5:], code)
+	if down {
+		msg[7] = 1
+	}
+	return msg
+}
+
+// TestHandle checks the parsing of the input messages and that messages of
+// the wrong type or size are rejected without changing the input. The player
+// holds key 42 before every message.
+func TestHandle(t *testing.T) {
+	held := map[uint16]bool{42: true}
+	for _, test := range []struct {
+		name    string
+		msg     []byte
+		invalid bool
+		pad     padState
+		keys    map[uint16]bool
+	}{
+		{name: "gamepad", msg: gamepadMessage(7, 0x0101, [4]int16{-32768, 32767, 1, -1}), pad: padState{buttons: 0x0101, axes: [4]int16{-32768, 32767, 1, -1}}, keys: held},
+		{name: "key down", msg: keyboardMessage(7, 273, true), keys: map[uint16]bool{42: true, 273: true}},
+		{name: "key up", msg: keyboardMessage(7, 42, false), keys: map[uint16]bool{}},
+		{name: "empty", msg: []byte{}, invalid: true, keys: held},
+		{name: "unknown type", msg: []byte{0x7f, 0, 0, 0, 0}, invalid: true, keys: held},
+		{name: "short gamepad", msg: gamepadMessage(7, 1, [4]int16{})[:gamepadMessageSize-1], invalid: true, keys: held},
+		{name: "long keyboard", msg: append(keyboardMessage(7, 273, true), 0), invalid: true, keys: held},
+	} {
+		in := newInputState(1)
+		p, err := in.join(context.Background(), "session", -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.keys[42] = true
+
+		err = in.handle(p, test.msg)
+		if (err != nil) != test.invalid {
+			t.Errorf("%s: got error %v, expected invalid %v", test.name, err, test.invalid)
+		}
+		if p.pad != test.pad {
+			t.Errorf("%s: pad is %+v, expected %+v", test.name, p.pad, test.pad)
+		}
+		if !reflect.DeepEqual(p.keys, test.keys) {
+			t.Errorf("%s: keys are %v, expected %v", test.name, p.keys, test.keys)
+		}
+		pending := 1
+		if test.invalid {
+			pending = 0
+		}
+		if len(in.pending) != pending {
+			t.Errorf("%s: %d inputs pending, expected %d", test.name, len(in.pending), pending)
+		}
+	}
+}
+
+// TestInputAck joins a player, sends it input, polls it for a frame and
+// checks that the input is acked with its timestamp once that frame is sent,
+// and not before
+func TestInputAck(t *testing.T) {
+	in := newInputState(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := in.join(ctx, "session", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := in.portOf("session"); port != 1 {
+		t.Fatalf("session joined port %d, expected 1", port)
+	}
+	channel := &fakeChannel{}
+	p.channel = channel
+
+	if err = in.handle(p, gamepadMessage(0xdeadbeef, 1<<8, [4]int16{})); err != nil {
+		t.Fatal(err)
+	}
+	in.poll(5)
+	if got := in.state(1, deviceJoypad, 0, 8); got != 1 {
+		t.Errorf("button 8 of port 1 reads %d after the poll, expected 1", got)
+	}
+	if got := in.state(0, deviceJoypad, 0, 8); got != 0 {
+		t.Errorf("button 8 of port 0 reads %d, expected 0", got)
+	}
+
+	in.frameSent(4)
+	if len(channel.sent) != 0 {
+		t.Fatalf("input acked before its frame was sent")
+	}
+	in.frameSent(5)
+	if len(channel.sent) != 1 {
+		t.Fatalf("%d acks sent once the frame was sent, expected 1", len(channel.sent))
+	}
+	ack := channel.sent[0]
+	if len(ack) != ackMessageSize || ack[0] != msgAck {
+		t.Fatalf("ack %x is not an ack message", ack)
+	}
+	if timestamp := binary.LittleEndian.Uint32(ack[1:]); timestamp != 0xdeadbeef {
+		t.Errorf("ack timestamp is %#x, expected 0xdeadbeef", timestamp)
+	}
+	if len(in.applied) != 0 {
+		t.Errorf("%d inputs still waiting once acked", len(in.applied))
+	}
+}
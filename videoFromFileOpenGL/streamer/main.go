@@ -1,8 +1,18 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"image"
 	"runtime"
+	"time"
+	"unsafe"
 
+	"github.com/jtestard/tinygo-webrtc/glcapture"
+	"github.com/jtestard/tinygo-webrtc/rtcconfig"
+	"github.com/jtestard/tinygo-webrtc/rtcsession"
+	"github.com/jtestard/tinygo-webrtc/vp8enc"
 	"github.com/piepacker/retrostream/core"
 	"github.com/piepacker/retrostream/state"
 	"github.com/piepacker/retrostream/video"
@@ -33,8 +43,42 @@ func init() {
 // runLoop(vid, time.Duration(0))
 //}
 
-func runLoop(vid *video.Video) {
+// gameStream sends the frames and the audio of the core to the sessions
+var gameStream *stream
+
+// inputs holds the input the players send, the core polls it
+var inputs *inputState
+
+// rtcConfig holds the listen address and the ICE settings of the server
+var rtcConfig *rtcconfig.Config
+
+// gameVideo is the video of retrostream, which draws the frames of the core to
+// the window, along with the buffers reading them back
+type gameVideo struct {
+	*video.Video
+	reader glcapture.Reader
+}
+
+// Capture reads back the frame Render just drew, as the window shows it, like
+// Video.Capture of the viewer. The readback is asynchronous, Capture returns
+// the frame of its previous call and nil on the first call.
+func (vid *gameVideo) Capture() *image.RGBA {
+	fbw, fbh := vid.Window.GetFramebufferSize()
+	return vid.reader.Capture(0, fbw, fbh)
+}
+
+// runLoop runs the core at fps frames per second until done is closed, the
+// refresh and audio callbacks of the core feed gameStream and its input
+// callbacks read inputs as it runs
+func runLoop(vid *gameVideo, fps float64, done <-chan struct{}) {
+	frameDuration := time.Duration(float64(time.Second) / fps)
+	next := time.Now()
 	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
 		//glfw.PollEvents()
 
 		if state.Global.CoreRunning {
@@ -48,28 +92,80 @@ func runLoop(vid *video.Video) {
 		}
 
 		vid.Render()
+		gameStream.captureHardwareFrame(vid)
+
+		// Run in real time since the viewers play the frames as they come. A
+		// loop running late starts over instead of catching up.
+		next = next.Add(frameDuration)
+		if time.Since(next) > frameDuration {
+			next = time.Now()
+		}
+		time.Sleep(time.Until(next))
 	}
 }
 
 func main() {
-
-	var gamePath string
-
-	vid := video.Init()
-	core.Init(vid)
-
-	if len(state.Global.CorePath) > 0 {
-		err := core.Load(state.Global.CorePath)
+	loadConfig := rtcconfig.Flags(flag.CommandLine)
+	corePath := flag.String("core", state.Global.CorePath, "libretro core to run")
+	gamePath := flag.String("game", "", "game loaded by the core")
+	pixelFormatFlag := flag.String("pixel-format", "auto", "pixel format of the core frames: auto, 0rgb1555, xrgb8888 or rgb565")
+	players := flag.Int("players", 2, "number of ports of the core the sessions can control")
+	quantizer := flag.Int("quantizer", vp8enc.DefaultQuantizer, "VP8 quantizer index, from 0 (best quality) to 127 (smallest frames)")
+	flag.Parse()
+	var err error
+	rtcConfig, err = loadConfig()
+	checkNoError(err)
+	checkNoError(rtcConfig.Open())
+	pixelFormat, err := parsePixelFormat(*pixelFormatFlag)
+	checkNoError(err)
+
+	vid := &gameVideo{Video: video.Init()}
+	core.Init(vid.Video)
+	// The frames are read back from the context of the window
+	checkNoError(glcapture.Init(nil))
+
+	if len(*corePath) > 0 {
+		err := core.Load(*corePath)
 		checkNoError(err)
 	}
 
-	if len(gamePath) > 0 {
-		if err := core.LoadGame(gamePath); err != nil {
+	if len(*gamePath) > 0 {
+		if err := core.LoadGame(*gamePath); err != nil {
 			panic(err)
 		}
 	}
 
-	runLoop(vid)
+	// Loading the game sets the callbacks of the core, they are wrapped
+	// afterwards. The frames are still rendered to the window.
+	avInfo := state.Global.Core.GetSystemAVInfo()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	gameStream = newStream(avInfo.Timing.FPS, avInfo.Timing.SampleRate, pixelFormat)
+	inputs = newInputState(*players)
+	gameStream.sent = inputs.frameSent
+	checkNoError(gameStream.start(ctx, *quantizer))
+	state.Global.Core.SetVideoRefresh(func(data unsafe.Pointer, width, height, pitch int32) {
+		vid.Refresh(data, width, height, pitch)
+		gameStream.refresh(data, width, height, pitch)
+	})
+	state.Global.Core.SetAudioSample(gameStream.audioSample)
+	state.Global.Core.SetAudioSampleBatch(gameStream.audioSampleBatch)
+	// The input polled is applied to the frame the core is running
+	state.Global.Core.SetInputPoll(func() { inputs.poll(gameStream.frameCount + 1) })
+	state.Global.Core.SetInputState(inputs.state)
+
+	// The core and the window own the main thread, the server runs aside and
+	// stops the core once it shut down
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		fmt.Printf("now serving on %s\n", rtcConfig.Listen)
+		err := rtcsession.Serve(rtcConfig.Listen, newHandler(), sessions)
+		rtcConfig.Close()
+		checkNoError(err)
+	}()
+
+	runLoop(vid, avInfo.Timing.FPS, stopped)
 
 	// Unload and deinit in the core.
 	core.Unload()
@@ -80,151 +176,3 @@ func checkNoError(err error) {
 		panic(err)
 	}
 }
-
-//var peerConnection *webrtc.PeerConnection
-//var lock sync.Mutex
-//
-//func startWebRTCSession() {
-//	if peerConnection != nil {
-//		w.WriteHeader(http.StatusBadRequest)
-//		w.Write([]byte("session already started. Please close before re-opening"))
-//		return
-//	}
-//
-//	// Everything below is the Pion WebRTC API! Thanks for using it ❤️.
-//	buf, err := ioutil.ReadAll(r.Body)
-//	checkNoError(err)
-//
-//	// The mirrorweb rtc offer is sent over in the body of the request
-//	offer := webrtc.SessionDescription{}
-//	decode(string(buf), &offer)
-//
-//	// We make our own mediaEngine so we can place the sender's codecs in it. Since we are echoing their RTP packet
-//	// back to them we are actually codec agnostic - we can accept all their codecs. This also ensures that we use the
-//	// dynamic media type from the sender in our answer.
-//	mediaEngine := webrtc.MediaEngine{}
-//
-//	// Add codecs to the mediaEngine. Note that even though we are only going to echo back the sender's video we also
-//	// add audio codecs. This is because createAnswer will create an audioTransceiver and associated SDP and we currently
-//	// cannot tell it not to. The audio SDP must match the sender's codecs too...
-//	err = mediaEngine.PopulateFromSDP(offer)
-//	checkNoError(err)
-//
-//	videoCodecs := mediaEngine.GetCodecsByKind(webrtc.RTPCodecTypeVideo)
-//	if len(videoCodecs) == 0 {
-//		panic("Offer contained no video codecs")
-//	}
-//
-//	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
-//
-//	// Prepare the configuration
-//	config := webrtc.Configuration{
-//		ICEServers: []webrtc.ICEServer{
-//			{
-//				URLs: []string{"stun:stun.l.google.com:19302"},
-//			},
-//		},
-//	}
-//	// Create a new RTCPeerConnection
-//	peerConnection, err = api.NewPeerConnection(config)
-//	checkNoError(err)
-//
-//	// Set the remote SessionDescription
-//	err = peerConnection.SetRemoteDescription(offer)
-//	checkNoError(err)
-//
-//	// Create Track that we send video back to browser on
-//	outputTrack, err := peerConnection.NewTrack(videoCodecs[0].PayloadType, rand.Uint32(), "video", "pion")
-//	checkNoError(err)
-//
-//	// Add this newly created track to the PeerConnection
-//	_, err = peerConnection.AddTrack(outputTrack)
-//	checkNoError(err)
-//
-//	// Set a handler for when a new remote track starts, this handler copies inbound RTP packets,
-//	// replaces the SSRC and sends them back
-//	peerConnection.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
-//		// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
-//		// This is a temporary fix until we implement incoming RTCP events, then we would push a PLI only when a viewer requests it
-//		doneChan := make(chan struct{})
-//		go func() {
-//			ticker := time.NewTicker(time.Second * 3)
-//			loop:
-//			for {
-//				select {
-//					case <- ticker.C:
-//						errSend := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: track.SSRC()}})
-//						if errSend != nil {
-//							fmt.Println(errSend)
-//						}
-//					case <-doneChan:
-//						break loop
-//				}
-//			}
-//		}()
-//
-//		fmt.Printf("Track has started, of type %d: %s \n", track.PayloadType(), track.Codec().Name)
-//		for {
-//			// Read RTP packets being sent to Pion
-//			rtp, readErr := track.ReadRTP()
-//			if readErr == io.EOF {
-//				doneChan <- struct{}{}
-//				break
-//			}
-//			checkNoError(readErr)
-//
-//			// Replace the SSRC with the SSRC of the outbound track.
-//			// The only change we are making replacing the SSRC, the RTP packets are unchanged otherwise
-//			rtp.SSRC = outputTrack.SSRC()
-//
-//			writeErr := outputTrack.WriteRTP(rtp)
-//			checkNoError(writeErr)
-//		}
-//	})
-//	// Set the handler for ICE connection state
-//	// This will notify you when the peer has connected/disconnected
-//	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-//		fmt.Printf("Connection State has changed %s \n", connectionState.String())
-//	})
-//
-//	// Create an answer
-//	answer, err := peerConnection.CreateAnswer(nil)
-//	checkNoError(err)
-//
-//	// Sets the LocalDescription, and starts our UDP listeners
-//	err = peerConnection.SetLocalDescription(answer)
-//	checkNoError(err)
-//
-//	// return the answer to the browser in base64
-//	_, err = w.Write([]byte(encode(answer)))
-//	checkNoError(err)
-//	fmt.Println("response sent to browser")
-//
-//	// print the answer to the logs
-//	fmt.Println(encode(answer))
-//}
-//
-//// Encode encodes the input in base64
-//// It can optionally zip the input before encoding
-//func encode(obj interface{}) string {
-//	b, err := json.Marshal(obj)
-//	if err != nil {
-//		panic(err)
-//	}
-//
-//	return base64.StdEncoding.EncodeToString(b)
-//}
-//
-//// Decode decodes the input from base64
-//// It can optionally unzip the input after decoding
-//func decode(in string, obj interface{}) {
-//	b, err := base64.StdEncoding.DecodeString(in)
-//	if err != nil {
-//		panic(err)
-//	}
-//
-//	err = json.Unmarshal(b, obj)
-//	if err != nil {
-//		panic(err)
-//	}
-//}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jtestard/tinygo-webrtc/rtcsession"
+	"github.com/pion/webrtc/v3"
+)
+
+// sessions are the open sessions, by ID
+var sessions = rtcsession.NewRegistry()
+
+// newHandler routes the requests of the player page and of the signaling
+// endpoints, which follow the /webrtc/open and /webrtc/close handshake of the
+// other servers
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", getWeb)
+	mux.HandleFunc("/webrtc/open", startWebRTCSession)
+	mux.HandleFunc("/webrtc/close", closeWebRTCSession)
+	mux.HandleFunc("/webrtc/ws", rtcsession.WebSocketHandler(sessions, openFreePortSession))
+	mux.HandleFunc("/webrtc/stats", rtcsession.StatsHandler(sessions))
+	mux.Handle("/metrics", rtcsession.MetricsHandler)
+	mux.Handle("/static/stats.js", rtcsession.StatsScript)
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	return mux
+}
+
+// getWeb returns the player page
+func getWeb(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := template.ParseFiles("demo.html")
+	if err != nil {
+		rtcsession.WriteError(w, rtcsession.ErrInternal(err))
+		return
+	}
+
+	tmpl.Execute(w, rtcConfig.Frontend())
+}
+
+// sessionResponse is returned by /webrtc/open. The ID must be passed back to
+// /webrtc/close. Port is the port of the core the session controls, it is -1
+// when the session only watches.
+type sessionResponse struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	Port        int    `json:"port"`
+}
+
+func closeWebRTCSession(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	s := sessions.Remove(id)
+	if s == nil {
+		rtcsession.WriteError(w, rtcsession.ErrSessionNotFound(id))
+		return
+	}
+	if err := s.Close(); err != nil {
+		rtcsession.WriteError(w, rtcsession.ErrInternal(err))
+		return
+	}
+	fmt.Printf("session %s closed\n", s.ID)
+}
+
+func startWebRTCSession(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	var err error
+	defer func() { rtcsession.ObserveOpen("open", start, err) }()
+
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err = rtcsession.ErrBadOffer(err)
+		rtcsession.WriteError(w, err)
+		return
+	}
+
+	offer := webrtc.SessionDescription{}
+	if err = decode(string(buf), &offer); err != nil {
+		err = rtcsession.ErrBadOffer(err)
+		rtcsession.WriteError(w, err)
+		return
+	}
+
+	// The session picks its port with ?port=<n>, it gets the first free one
+	// otherwise
+	port := -1
+	if value := r.URL.Query().Get("port"); value != "" {
+		if port, err = strconv.Atoi(value); err != nil {
+			err = rtcsession.ErrInvalidPort(value, len(inputs.players))
+			rtcsession.WriteError(w, err)
+			return
+		}
+	}
+
+	s, answer, err := openSession(offer, port, nil)
+	if err != nil {
+		rtcsession.WriteError(w, err)
+		return
+	}
+
+	response := sessionResponse{ID: s.ID, Description: encode(answer), Port: inputs.portOf(s.ID)}
+	w.Header().Set("Content-Type", "application/json")
+	if encodeErr := json.NewEncoder(w).Encode(response); encodeErr != nil {
+		log.Printf("session %s: could not send response: %v\n", s.ID, encodeErr)
+		return
+	}
+	fmt.Printf("session %s: response sent to browser\n", s.ID)
+}
+
+// openFreePortSession opens a session controlling the first free port, the
+// WebSocket signaling does not pick a port
+func openFreePortSession(offer webrtc.SessionDescription, onCandidate func(*webrtc.ICECandidate)) (*rtcsession.Session, webrtc.SessionDescription, error) {
+	return openSession(offer, -1, onCandidate)
+}
+
+// openSession creates the peer connection streaming the core for offer and
+// registers it. The video is sent as VP8, the audio as Opus when the offer
+// accepts it. The session controls port, or the first free port when port is
+// -1, with the input it sends on its data channel. When onCandidate is set
+// the local candidates are trickled to it instead of being gathered into the
+// answer.
+func openSession(offer webrtc.SessionDescription, port int, onCandidate func(*webrtc.ICECandidate)) (s *rtcsession.Session, answer webrtc.SessionDescription, err error) {
+	videoCodec, err := offeredCodec(offer, webrtc.RTPCodecTypeVideo, webrtc.MimeTypeVP8)
+	if err != nil {
+		return nil, answer, err
+	}
+	if videoCodec == nil {
+		return nil, answer, rtcsession.ErrUnsupportedCodec("remote peer does not support VP8")
+	}
+	audioCodec, err := offeredCodec(offer, webrtc.RTPCodecTypeAudio, webrtc.MimeTypeOpus)
+	if err != nil {
+		return nil, answer, err
+	}
+
+	// The answer accepts the codecs sent, with the payload types of the offer
+	mediaEngine := &webrtc.MediaEngine{}
+	if err = mediaEngine.RegisterCodec(*videoCodec, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, answer, rtcsession.ErrInternal(err)
+	}
+	if audioCodec != nil {
+		if err = mediaEngine.RegisterCodec(*audioCodec, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, answer, rtcsession.ErrInternal(err)
+		}
+	}
+
+	pc, err := rtcConfig.NewPeerConnection(mediaEngine)
+	if err != nil {
+		return nil, answer, rtcsession.ErrInternal(err)
+	}
+	sess := sessions.New(pc)
+	defer func() {
+		if err != nil {
+			sess.Abort()
+		}
+	}()
+
+	// The session sends the sender reports about its tracks
+	track, err := webrtc.NewTrackLocalStaticRTP(videoCodec.RTPCodecCapability, "video", "core")
+	if err != nil {
+		return nil, answer, rtcsession.ErrInternal(err)
+	}
+	videoTrack, sender, err := sess.AddTrack(track)
+	if err != nil {
+		return nil, answer, rtcsession.ErrInternal(err)
+	}
+	go sess.RTCP.ReadRTCP(sender, nil)
+
+	var audioTrack sampleWriter
+	if audioCodec == nil {
+		log.Printf("remote peer does not support Opus, sending video only\n")
+	} else {
+		track, err := webrtc.NewTrackLocalStaticRTP(audioCodec.RTPCodecCapability, "audio", "core")
+		if err != nil {
+			return nil, answer, rtcsession.ErrInternal(err)
+		}
+		reported, audioSender, err := sess.AddTrack(track)
+		if err != nil {
+			return nil, answer, rtcsession.ErrInternal(err)
+		}
+		go sess.RTCP.ReadRTCP(audioSender, nil)
+		audioTrack = reported
+	}
+
+	// The port is freed once the session is closed
+	player, err := inputs.join(sess.Context(), sess.ID, port)
+	if err != nil {
+		return nil, answer, err
+	}
+	pc.OnDataChannel(func(channel *webrtc.DataChannel) {
+		if channel.Label() != inputChannelLabel {
+			log.Printf("session %s: ignoring data channel %q\n", sess.ID, channel.Label())
+			return
+		}
+		if player == nil {
+			log.Printf("session %s: every port is taken, ignoring input\n", sess.ID)
+			return
+		}
+		inputs.attach(player, channel)
+	})
+
+	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		fmt.Printf("Connection State has changed %s \n", connectionState.String())
+		sess.WatchICE(connectionState)
+	})
+
+	if err = pc.SetRemoteDescription(offer); err != nil {
+		return nil, answer, rtcsession.ErrBadOffer(err)
+	}
+
+	// Without trickle the answer lists every candidate, it is only complete once
+	// gathering is
+	var gathered <-chan struct{}
+	if onCandidate != nil {
+		pc.OnICECandidate(onCandidate)
+	} else {
+		gathered = webrtc.GatheringCompletePromise(pc)
+	}
+
+	answer, err = pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, answer, rtcsession.ErrInternal(err)
+	}
+	// Sets the LocalDescription, and starts our UDP listeners
+	if err = pc.SetLocalDescription(answer); err != nil {
+		return nil, answer, rtcsession.ErrInternal(err)
+	}
+	if gathered != nil {
+		<-gathered
+		answer = *pc.LocalDescription()
+	}
+
+	// The session receives the stream until it is closed
+	gameStream.subscribe(sess.Context(), videoTrack, audioTrack)
+	return sessions.Add(sess), answer, nil
+}
+
+// offeredCodec returns the first codec of kind with mimeType the offer
+// proposes, or nil if there is none
+func offeredCodec(offer webrtc.SessionDescription, kind webrtc.RTPCodecType, mimeType string) (*webrtc.RTPCodecParameters, error) {
+	codecs, err := rtcsession.OfferedCodecs(offer, kind)
+	if err != nil {
+		return nil, err
+	}
+	for i := range codecs {
+		if strings.EqualFold(codecs[i].MimeType, mimeType) {
+			return &codecs[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// encode encodes obj as base64 JSON
+func encode(obj interface{}) string {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// decode decodes base64 JSON into obj
+func decode(in string, obj interface{}) error {
+	b, err := base64.StdEncoding.DecodeString(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, obj)
+}
@@ -0,0 +1,142 @@
+/* eslint-env browser */
+// input sends the gamepad and the keyboard of the player to the streamer on a
+// data channel, in the binary protocol described in README.md, and measures
+// the latency from the acks the streamer sends back
+const input = (() => {
+  const MSG_GAMEPAD = 0x01
+  const MSG_KEYBOARD = 0x02
+  const MSG_ACK = 0x81
+
+  // Libretro joypad buttons
+  const B = 0, Y = 1, SELECT = 2, START = 3, UP = 4, DOWN = 5, LEFT = 6, RIGHT = 7
+  const A = 8, X = 9, L = 10, R = 11, L2 = 12, R2 = 13, L3 = 14, R3 = 15
+
+  // Buttons of the standard gamepad mapping, in the order of Gamepad.buttons.
+  // The positions match: the bottom face button is B on a libretro pad.
+  const gamepadButtons = [B, A, Y, X, L, R, L2, R2, SELECT, START, L3, R3, UP, DOWN, LEFT, RIGHT]
+
+  // Keys playing the pad of players without a gamepad
+  const keyButtons = {
+    ArrowUp: UP, ArrowDown: DOWN, ArrowLeft: LEFT, ArrowRight: RIGHT,
+    KeyZ: B, KeyX: A, KeyA: Y, KeyS: X, KeyQ: L, KeyW: R,
+    Enter: START, ShiftRight: SELECT
+  }
+
+  // Libretro key codes of the keys that are not printable characters
+  const keyCodes = {
+    Backspace: 8, Tab: 9, Enter: 13, Escape: 27, Space: 32, Delete: 127,
+    ArrowUp: 273, ArrowDown: 274, ArrowRight: 275, ArrowLeft: 276,
+    Insert: 277, Home: 278, End: 279, PageUp: 280, PageDown: 281,
+    F1: 282, F2: 283, F3: 284, F4: 285, F5: 286, F6: 287, F7: 288, F8: 289, F9: 290, F10: 291, F11: 292, F12: 293,
+    ShiftRight: 303, ShiftLeft: 304, ControlRight: 305, ControlLeft: 306, AltRight: 307, AltLeft: 308
+  }
+
+  let channel
+  let keyPad = 0
+  let sent
+  let latency = {count: 0, server: 0, roundTrip: 0}
+
+  const timestamp = () => Math.floor(performance.now()) >>> 0
+
+  // libretroKey returns the libretro key code of a keyboard event, or
+  // undefined for keys the cores do not know
+  const libretroKey = event => {
+    if (event.code in keyCodes) {
+      return keyCodes[event.code]
+    }
+    if (/^Key[A-Z]$/.test(event.code)) {
+      return event.code.charCodeAt(3) + 32
+    }
+    if (/^Digit[0-9]$/.test(event.code)) {
+      return event.code.charCodeAt(5)
+    }
+  }
+
+  const sendKey = (event, down) => {
+    if (event.repeat) {
+      return
+    }
+    if (event.code in keyButtons) {
+      const bit = 1 << keyButtons[event.code]
+      keyPad = down ? keyPad | bit : keyPad & ~bit
+      event.preventDefault()
+    }
+    const code = libretroKey(event)
+    if (!channel || channel.readyState !== 'open' || code === undefined) {
+      return
+    }
+    const msg = new DataView(new ArrayBuffer(8))
+    msg.setUint8(0, MSG_KEYBOARD)
+    msg.setUint32(1, timestamp(), true)
+    msg.setUint16(5, code, true)
+    msg.setUint8(7, down ? 1 : 0)
+    channel.send(msg.buffer)
+  }
+
+  // sendPad sends the state of the pad when it changed, the buttons of the
+  // first gamepad and of the keyboard are merged
+  const sendPad = () => {
+    requestAnimationFrame(sendPad)
+    let buttons = keyPad
+    let axes = [0, 0, 0, 0]
+    const gamepad = [...navigator.getGamepads()].find(g => g && g.mapping === 'standard')
+    if (gamepad) {
+      gamepad.buttons.forEach((b, i) => {
+        if (b.pressed && i < gamepadButtons.length) {
+          buttons |= 1 << gamepadButtons[i]
+        }
+      })
+      axes = gamepad.axes.slice(0, 4).map(a => Math.round(a * 32767))
+    }
+
+    const state = buttons + ':' + axes.join(',')
+    if (!channel || channel.readyState !== 'open' || state === sent) {
+      return
+    }
+    sent = state
+    const msg = new DataView(new ArrayBuffer(15))
+    msg.setUint8(0, MSG_GAMEPAD)
+    msg.setUint32(1, timestamp(), true)
+    msg.setUint16(5, buttons, true)
+    axes.forEach((a, i) => msg.setInt16(7 + 2 * i, a, true))
+    channel.send(msg.buffer)
+  }
+
+  // onAck averages the latency of the acked inputs: the time the streamer
+  // took to send a frame with the input, and the time until the ack arrived,
+  // which follows the frame. The decoding and the display of the frame add
+  // to the latter.
+  const onAck = event => {
+    const msg = new DataView(event.data)
+    if (msg.byteLength !== 9 || msg.getUint8(0) !== MSG_ACK) {
+      return
+    }
+    latency.count++
+    latency.server += msg.getUint32(5, true) / 1000
+    latency.roundTrip += ((timestamp() - msg.getUint32(1, true)) >>> 0)
+  }
+
+  const showLatency = () => {
+    if (latency.count > 0) {
+      document.getElementById('latency').textContent =
+        'input to frame sent: ' + (latency.server / latency.count).toFixed(1) + ' ms, ' +
+        'input to ack: ' + (latency.roundTrip / latency.count).toFixed(1) + ' ms'
+    }
+    latency = {count: 0, server: 0, roundTrip: 0}
+  }
+
+  document.addEventListener('keydown', e => sendKey(e, true))
+  document.addEventListener('keyup', e => sendKey(e, false))
+  requestAnimationFrame(sendPad)
+  setInterval(showLatency, 1000)
+
+  return {
+    // attach creates the input channel on pc, before the offer is made
+    attach: pc => {
+      channel = pc.createDataChannel('input')
+      channel.binaryType = 'arraybuffer'
+      channel.onmessage = onAck
+      sent = undefined
+    }
+  }
+})()
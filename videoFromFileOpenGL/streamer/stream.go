@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"image"
+	"log"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/hraban/opus"
+	"github.com/jtestard/tinygo-webrtc/glcapture"
+	"github.com/jtestard/tinygo-webrtc/vp8enc"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	// queueSize is the number of frames waiting for an encoder, frames are
+	// dropped once it is full so that the core never waits on the encoders
+	queueSize = 4
+	// maxOpusPacketSize bounds the size of an encoded Opus frame
+	maxOpusPacketSize = 1500
+)
+
+// stream encodes the frames and the audio of the core once, as VP8 and Opus,
+// and sends them to every subscribed session. The callbacks of the core run
+// on the main thread, the encoders run on their own goroutines.
+type stream struct {
+	fps         float64
+	pixelFormat int
+
+	// frameCount is the number of frames the core produced, including the
+	// dropped ones. It is only used on the main thread.
+	frameCount int64
+	frames     chan videoFrame
+	resampler  *resampler
+	audio      chan []int16
+
+	// hwFrame is set when a core rendering in hardware drew a frame, which
+	// captureHardwareFrame reads back. hwIndex is the index of the frame the
+	// last capture queued.
+	hwFrame bool
+	hwIndex int64
+
+	// sent, when set, is called with the index of every frame sent
+	sent func(index int64)
+
+	lock    sync.Mutex
+	viewers map[*viewer]struct{}
+}
+
+// videoFrame is a converted frame of the core waiting to be encoded, index is
+// its position in the frames of the core
+type videoFrame struct {
+	img   *image.YCbCr
+	index int64
+}
+
+// sampleWriter is a track of a session receiving the stream
+type sampleWriter interface {
+	WriteSample(media.Sample) error
+}
+
+// viewer is a session receiving the stream, audio is nil when the session
+// cannot decode Opus
+type viewer struct {
+	video sampleWriter
+	audio sampleWriter
+}
+
+// newStream returns a stream of a core running at fps frames per second with
+// audio at sampleRate, pixelFormat may be pixelFormatAuto
+func newStream(fps, sampleRate float64, pixelFormat int) *stream {
+	return &stream{
+		fps:         fps,
+		pixelFormat: pixelFormat,
+		frames:      make(chan videoFrame, queueSize),
+		resampler:   newResampler(sampleRate),
+		audio:       make(chan []int16, queueSize),
+		viewers:     map[*viewer]struct{}{},
+	}
+}
+
+// start runs the encoders until ctx is done
+func (s *stream) start(ctx context.Context, quantizer int) error {
+	audioEncoder, err := opus.NewEncoder(opusSampleRate, 2, opus.AppRestrictedLowdelay)
+	if err != nil {
+		return err
+	}
+	go s.encodeVideo(ctx, vp8enc.NewEncoder(quantizer))
+	go s.encodeAudio(ctx, audioEncoder)
+	return nil
+}
+
+// subscribe sends the stream on video, and on audio unless it is nil, until
+// ctx is done
+func (s *stream) subscribe(ctx context.Context, video, audio sampleWriter) {
+	v := &viewer{video: video, audio: audio}
+	s.lock.Lock()
+	s.viewers[v] = struct{}{}
+	s.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		s.lock.Lock()
+		delete(s.viewers, v)
+		s.lock.Unlock()
+	}()
+}
+
+// watched tells whether a session receives the stream, nothing is converted
+// nor encoded otherwise
+func (s *stream) watched() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.viewers) > 0
+}
+
+// capturer reads back the frames drawn to the window, like Video.Capture of
+// the viewer: each call returns the frame of the previous one
+type capturer interface {
+	Capture() *image.RGBA
+}
+
+// refresh is the video refresh callback of the core. It converts the frame
+// and queues it for the encoder. Frames the core duplicates are not sent, the
+// viewers keep showing the last frame. Hardware rendered frames are read back
+// by captureHardwareFrame.
+func (s *stream) refresh(data unsafe.Pointer, width, height, pitch int32) {
+	s.frameCount++
+	if data == nil || !s.watched() {
+		return
+	}
+	if uintptr(data) == hwFrameBufferValid {
+		s.hwFrame = true
+		return
+	}
+
+	format := s.pixelFormat
+	if format == pixelFormatAuto {
+		format = guessPixelFormat(int(width), int(pitch))
+	}
+	img := convertFrame(frameBytes(data, int(height), int(pitch)), int(width), int(height), int(pitch), format)
+	s.queue(videoFrame{img: img, index: s.frameCount})
+}
+
+// captureHardwareFrame reads back the frame a core rendering in hardware drew,
+// as it was composited on the window, and queues it for the encoder. It is
+// called on the main thread after the window was rendered. The read is
+// asynchronous, the frame queued is the one read at the previous call so the
+// GPU is never waited for.
+func (s *stream) captureHardwareFrame(window capturer) {
+	if !s.hwFrame {
+		return
+	}
+	s.hwFrame = false
+
+	img := window.Capture()
+	index := s.hwIndex
+	s.hwIndex = s.frameCount
+	// A frame read before the core skipped frames, or before the stream
+	// was last watched, is stale
+	if img == nil || index != s.frameCount-1 {
+		return
+	}
+	s.queue(videoFrame{img: glcapture.I420(img), index: index})
+}
+
+// queue queues a converted frame for the encoder
+func (s *stream) queue(f videoFrame) {
+	select {
+	case s.frames <- f:
+	default:
+		// The encoder is late, the frame is skipped and the next one lasts
+		// longer
+	}
+}
+
+// audioSample is the single sample audio callback of the core
+func (s *stream) audioSample(left, right int16) {
+	if !s.watched() {
+		return
+	}
+	s.resampler.push(left, right, s.queueAudio)
+}
+
+// audioSampleBatch is the batch audio callback of the core, buf holds frames
+// interleaved little endian stereo samples
+func (s *stream) audioSampleBatch(buf []byte, frames int32) int32 {
+	if !s.watched() {
+		return frames
+	}
+	for i := 0; i < int(frames); i++ {
+		left := int16(binary.LittleEndian.Uint16(buf[4*i:]))
+		right := int16(binary.LittleEndian.Uint16(buf[4*i+2:]))
+		s.resampler.push(left, right, s.queueAudio)
+	}
+	return frames
+}
+
+// queueAudio queues an Opus frame worth of samples for the encoder
+func (s *stream) queueAudio(pcm []int16) {
+	select {
+	case s.audio <- pcm:
+	default:
+	}
+}
+
+// encodeVideo encodes the queued frames to VP8 until ctx is done. Every frame
+// is a key frame, so a session can start decoding at any frame.
+func (s *stream) encodeVideo(ctx context.Context, encoder *vp8enc.Encoder) {
+	last := int64(0)
+	for {
+		var f videoFrame
+		select {
+		case <-ctx.Done():
+			return
+		case f = <-s.frames:
+		}
+
+		data, err := encoder.Encode(f.img)
+		if err != nil {
+			log.Printf("could not encode frame %d: %v\n", f.index, err)
+			continue
+		}
+		// The sample lasts until this frame, skipped frames included
+		duration := time.Duration(float64(f.index-last) * float64(time.Second) / s.fps)
+		last = f.index
+		s.write(media.Sample{Data: data, Duration: duration}, func(v *viewer) sampleWriter { return v.video })
+		if s.sent != nil {
+			s.sent(f.index)
+		}
+	}
+}
+
+// encodeAudio encodes the queued samples to Opus until ctx is done
+func (s *stream) encodeAudio(ctx context.Context, encoder *opus.Encoder) {
+	buf := make([]byte, maxOpusPacketSize)
+	for {
+		var pcm []int16
+		select {
+		case <-ctx.Done():
+			return
+		case pcm = <-s.audio:
+		}
+
+		n, err := encoder.Encode(pcm, buf)
+		if err != nil {
+			log.Printf("could not encode audio: %v\n", err)
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, buf)
+		s.write(media.Sample{Data: data, Duration: opusFrameDuration}, func(v *viewer) sampleWriter { return v.audio })
+	}
+}
+
+// write sends sample on the track of every viewer picked by track
+func (s *stream) write(sample media.Sample, track func(*viewer) sampleWriter) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for v := range s.viewers {
+		t := track(v)
+		if t == nil {
+			continue
+		}
+		if err := t.WriteSample(sample); err != nil {
+			log.Printf("could not send sample: %v\n", err)
+		}
+	}
+}
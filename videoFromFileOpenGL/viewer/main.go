@@ -1,7 +1,10 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"image"
+	"image/draw"
 	"io"
 	"log"
 	"os"
@@ -9,10 +12,14 @@ import (
 	"time"
 
 	"github.com/go-gl/gl/v4.1-core/gl"
-	"github.com/go-gl/glfw/v3.2/glfw"
+	"github.com/go-gl/glfw/v3.3/glfw"
+	"github.com/jtestard/tinygo-webrtc/framedump"
+	"github.com/jtestard/tinygo-webrtc/glcapture"
+	"github.com/jtestard/tinygo-webrtc/offscreen"
+	"github.com/jtestard/tinygo-webrtc/testpattern"
 	"github.com/libretro/ludo/libretro"
-	"github.com/pion/webrtc/pkg/media"
-	"github.com/pion/webrtc/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
 )
 
 func init() {
@@ -31,8 +38,17 @@ func checkNoErrorWithMsg(msg string, err error) {
 	}
 }
 
+// glWindow is the window the viewer renders to, a GLFW window or an offscreen
+// one with -headless or without a display
+type glWindow interface {
+	GetFramebufferSize() (width, height int)
+	MakeContextCurrent()
+	ShouldClose() bool
+	SwapBuffers()
+}
+
 var (
-	window  *glfw.Window
+	window  glWindow
 	program uint32 // current program used for the game quad
 	vao     uint32
 	vbo     uint32
@@ -48,6 +64,8 @@ var (
 	// callback
 
 	Geom libretro.GameGeometry
+
+	dumper *framedump.Dumper // saves the rendered frames and screenshots
 )
 
 var vertices = []float32{
@@ -59,7 +77,22 @@ var vertices = []float32{
 }
 
 func main() {
-	configure(true)
+	pattern := flag.Bool("pattern", false, "show a generated test pattern instead of output.ivf")
+	headless := flag.Bool("headless", false, "render offscreen instead of to a window, which is the default without a display")
+	dumpOptions := framedump.Flags(flag.CommandLine)
+	flag.Parse()
+
+	var err error
+	dumper, err = framedump.New(*dumpOptions)
+	checkNoError(err)
+	defer dumper.Close()
+
+	configure(true, *headless)
+
+	if *pattern {
+		showPattern(testpattern.New(640, 360), 30)
+		return
+	}
 
 	// Open a IVF file and start reading using our IVFReader
 	file, ivfErr := os.Open("output.ivf")
@@ -71,7 +104,7 @@ func main() {
 	// Send our video file frame at a time. Pace our sending so we send it at the same speed it should be played back as.
 	// This isn't required since the video is timestamped, but we will such much higher loss if we send all at once.
 	sleepTime := time.Millisecond * time.Duration((float32(header.TimebaseNumerator)/float32(header.TimebaseDenominator))*1000)
-	for !window.ShouldClose() {
+	for !window.ShouldClose() && !dumper.Done() {
 		frame, _, ivfErr := ivf.ParseNextFrame()
 		if ivfErr == io.EOF {
 			break
@@ -79,56 +112,90 @@ func main() {
 		checkNoError(ivfErr)
 
 		time.Sleep(sleepTime)
-		ivfErr = videoTrack.WriteSample(media.Sample{Data: frame, Samples: 90000})
+		ivfErr = videoTrack.WriteSample(media.Sample{Data: frame, Duration: time.Second})
 		checkNoError(ivfErr)
 
 		gl.Clear(gl.COLOR_BUFFER_BIT | gl.DEPTH_BUFFER_BIT)
+		captureFrame()
 		window.SwapBuffers()
-		glfw.PollEvents()
+		pollEvents()
 	}
 	fmt.Println("video completed")
 }
 
-func configure(fullscreen bool) {
-	err := glfw.Init()
-	checkNoErrorWithMsg("could not initialize glfw: %v", err)
+// showPattern draws the frames of the test pattern at fps frames per second
+// until the window is closed. The raw I420 frames are converted to RGBA before
+// being uploaded to the game texture.
+func showPattern(pattern *testpattern.Generator, fps int) {
+	Geom = libretro.GameGeometry{
+		BaseWidth:   pattern.Width,
+		BaseHeight:  pattern.Height,
+		AspectRatio: float64(pattern.Width) / float64(pattern.Height),
+	}
+	fbw, fbh := window.GetFramebufferSize()
+	coreRatioViewport(fbw, fbh)
 
-	var m *glfw.Monitor
+	rgba := image.NewRGBA(image.Rect(0, 0, pattern.Width, pattern.Height))
+	for n := 0; !window.ShouldClose() && !dumper.Done(); n++ {
+		draw.Draw(rgba, rgba.Bounds(), pattern.Frame(n), image.Point{}, draw.Src)
 
-	if fullscreen {
-		m = glfw.GetMonitors()[0]
-		vm := m.GetVideoMode()
-		width = int32(vm.Width)
-		height = int32(vm.Height)
-	} else {
-		width = 320 * 3
-		height = 180 * 3
-	}
+		gl.ActiveTexture(gl.TEXTURE0)
+		gl.BindTexture(gl.TEXTURE_2D, texID)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+		gl.PixelStorei(gl.UNPACK_ROW_LENGTH, 0)
+		gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA8, int32(pattern.Width), int32(pattern.Height), 0, gl.RGBA, gl.UNSIGNED_BYTE, gl.Ptr(rgba.Pix))
 
-	// On OSX we have to force a core profile to not end up with 2.1 which cause
-	// a font drawing issue
-	if runtime.GOOS == "darwin" {
-		glfw.WindowHint(glfw.ContextVersionMajor, 3)
-		glfw.WindowHint(glfw.ContextVersionMinor, 2)
-		glfw.WindowHint(glfw.OpenGLProfile, glfw.OpenGLCoreProfile)
-		glfw.WindowHint(glfw.OpenGLForwardCompatible, glfw.True)
-	} else {
-		glfw.WindowHint(glfw.ContextVersionMajor, 2)
-		glfw.WindowHint(glfw.ContextVersionMinor, 1)
-		glfw.WindowHint(glfw.OpenGLProfile, glfw.OpenGLAnyProfile)
-		glfw.WindowHint(glfw.OpenGLForwardCompatible, glfw.False)
-	}
+		gl.Clear(gl.COLOR_BUFFER_BIT | gl.DEPTH_BUFFER_BIT)
+		gl.UseProgram(program)
+		gl.BindVertexArray(vao)
+		gl.DrawArrays(gl.TRIANGLE_STRIP, 0, 4)
+		gl.BindVertexArray(0)
+		gl.UseProgram(0)
 
-	window, err = glfw.CreateWindow(800, 600, "Hello world", nil, nil)
-	checkNoErrorWithMsg("could not create opengl renderer: %v", err)
+		captureFrame()
+		window.SwapBuffers()
+		pollEvents()
+		time.Sleep(time.Second / time.Duration(fps))
+	}
+}
 
-	window.MakeContextCurrent()
+// captureFrame hands the frame just drawn to the dumper, before it is swapped
+func captureFrame() {
+	err := dumper.Capture(func() image.Image {
+		w, h := window.GetFramebufferSize()
+		return glcapture.CaptureSync(0, w, h)
+	})
+	checkNoError(err)
+}
 
-	// Force a minimum size for the window.
-	window.SetSizeLimits(160, 120, glfw.DontCare, glfw.DontCare)
-	window.SetInputMode(glfw.CursorMode, glfw.CursorHidden)
+// pollEvents processes the events of the GLFW window, an offscreen one has
+// none
+func pollEvents() {
+	if _, ok := window.(*glfw.Window); ok {
+		glfw.PollEvents()
+	}
+}
 
-	err = gl.Init()
+// configure opens the window and sets up the game quad. The window is
+// offscreen when headless is set or when GLFW cannot be initialized.
+func configure(fullscreen, headless bool) {
+	offscreenWindow, err := offscreen.Fallback(headless, glfw.Init, 800, 600)
+	checkNoErrorWithMsg("could not render offscreen: %v", err)
+	if offscreenWindow != nil {
+		window = offscreenWindow
+		window.MakeContextCurrent()
+		err = gl.InitWithProcAddrFunc(offscreenWindow.ProcAddress)
+		if err == nil {
+			err = glcapture.Init(offscreenWindow.ProcAddress)
+		}
+	} else {
+		openWindow(fullscreen)
+		err = gl.Init()
+		if err == nil {
+			err = glcapture.Init(nil)
+		}
+	}
 	checkNoError(err)
 
 	gl.ClearColor(0, 0.5, 1.0, 1.0)
@@ -182,3 +249,49 @@ func configure(fullscreen bool) {
 	}
 
 }
+
+// openWindow opens the GLFW window and makes its context current
+func openWindow(fullscreen bool) {
+	var m *glfw.Monitor
+
+	if fullscreen {
+		m = glfw.GetMonitors()[0]
+		vm := m.GetVideoMode()
+		width = int32(vm.Width)
+		height = int32(vm.Height)
+	} else {
+		width = 320 * 3
+		height = 180 * 3
+	}
+
+	// On OSX we have to force a core profile to not end up with 2.1 which cause
+	// a font drawing issue
+	if runtime.GOOS == "darwin" {
+		glfw.WindowHint(glfw.ContextVersionMajor, 3)
+		glfw.WindowHint(glfw.ContextVersionMinor, 2)
+		glfw.WindowHint(glfw.OpenGLProfile, glfw.OpenGLCoreProfile)
+		glfw.WindowHint(glfw.OpenGLForwardCompatible, glfw.True)
+	} else {
+		glfw.WindowHint(glfw.ContextVersionMajor, 2)
+		glfw.WindowHint(glfw.ContextVersionMinor, 1)
+		glfw.WindowHint(glfw.OpenGLProfile, glfw.OpenGLAnyProfile)
+		glfw.WindowHint(glfw.OpenGLForwardCompatible, glfw.False)
+	}
+
+	w, err := glfw.CreateWindow(800, 600, "Hello world", nil, nil)
+	checkNoErrorWithMsg("could not create opengl renderer: %v", err)
+	window = w
+
+	w.MakeContextCurrent()
+
+	// Force a minimum size for the window.
+	w.SetSizeLimits(160, 120, glfw.DontCare, glfw.DontCare)
+	w.SetInputMode(glfw.CursorMode, glfw.CursorHidden)
+
+	// F12 saves a screenshot
+	w.SetKeyCallback(func(w *glfw.Window, key glfw.Key, scancode int, action glfw.Action, mods glfw.ModifierKey) {
+		if key == glfw.KeyF12 && action == glfw.Press {
+			dumper.RequestScreenshot()
+		}
+	})
+}
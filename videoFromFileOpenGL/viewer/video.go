@@ -1,9 +1,11 @@
 // Package video takes care on the game display. It also creates the window
-// using GLFW. It exports the Refresh callback used by the libretro
-// implementation.
+// using GLFW, or an offscreen one when there is no display. It exports the
+// Refresh callback used by the libretro implementation.
 package main
 
 import (
+	"errors"
+	"image"
 	"log"
 	"runtime"
 	"strconv"
@@ -12,6 +14,8 @@ import (
 
 	"github.com/go-gl/gl/all-core/gl"
 	"github.com/go-gl/glfw/v3.3/glfw"
+	"github.com/jtestard/tinygo-webrtc/glcapture"
+	"github.com/jtestard/tinygo-webrtc/offscreen"
 	"github.com/kivutar/glfont"
 	"github.com/libretro/ludo/libretro"
 	"github.com/libretro/ludo/settings"
@@ -33,11 +37,25 @@ type WindowInterface interface {
 	SwapBuffers()
 }
 
+// headlessWindow is the offscreen window used without a display. It has no
+// size limits, cursor nor title, and never gets any input.
+type headlessWindow struct {
+	*offscreen.Window
+}
+
+func (headlessWindow) SetSizeLimits(minw, minh, maxw, maxh int)    {}
+func (headlessWindow) SetInputMode(mode glfw.InputMode, value int) {}
+func (headlessWindow) GetKey(key glfw.Key) glfw.Action             { return glfw.Release }
+func (headlessWindow) SetTitle(string)                             {}
+
 // Video holds the state of the video package
 type Video struct {
 	Window WindowInterface
 	Geom   libretro.GameGeometry
 	Font   *glfont.Font
+	// Headless renders to an offscreen buffer instead of a window. It is set
+	// by Configure when the window cannot be created.
+	Headless bool
 
 	program              uint32 // current program used for the game quad
 	defaultProgram       uint32 // default program used for the game quad
@@ -58,6 +76,8 @@ type Video struct {
 	pixType       uint32
 	bpp           int32
 	width, height int32 // dimensions set by the refresh callback
+
+	reader glcapture.Reader // buffers of the asynchronous Capture
 }
 
 // Init instanciates the video package
@@ -147,13 +167,18 @@ func (video *Video) InitFramebuffer(width, height int) {
 	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
 }
 
-// Configure instanciates the video package
-func (video *Video) Configure(fullscreen bool) {
+// openWindow creates the GLFW window, full screen on the monitor of the
+// settings when fullscreen is set
+func (video *Video) openWindow(fullscreen bool) error {
 	var width, height int
 	var m *glfw.Monitor
 
 	if fullscreen {
-		m = glfw.GetMonitors()[settings.Current.VideoMonitorIndex]
+		monitors := glfw.GetMonitors()
+		if settings.Current.VideoMonitorIndex >= len(monitors) {
+			return errors.New("no monitor")
+		}
+		m = monitors[settings.Current.VideoMonitorIndex]
 		vm := m.GetVideoMode()
 		width = vm.Width
 		height = vm.Height
@@ -176,11 +201,43 @@ func (video *Video) Configure(fullscreen bool) {
 		glfw.WindowHint(glfw.OpenGLForwardCompatible, glfw.False)
 	}
 
+	window, err := glfw.CreateWindow(width, height, "Ludo", m, nil)
+	if err != nil {
+		return err
+	}
+	video.Window = window
+	return nil
+}
+
+// openHeadless creates an offscreen window of the size of the windowed mode.
+// Its pbuffer is the default framebuffer, so that Render and Refresh draw to
+// it as they would to a window.
+func (video *Video) openHeadless() error {
+	window, err := offscreen.NewWindow(320*3, 180*3)
+	if err != nil {
+		return err
+	}
+	video.Window = headlessWindow{window}
+	return nil
+}
+
+// Configure instanciates the video package. It renders offscreen when
+// Headless is set or when the window cannot be created, typically because
+// there is no display.
+func (video *Video) Configure(fullscreen bool) {
 	var err error
-	video.Window = glfw.CreateWindow(width, height, "Ludo", m, nil)
-	if video.Window == nil {
-		panic("Window creation failed")
+	if video.Headless {
+		err = video.openHeadless()
+	} else if err = video.openWindow(fullscreen); err != nil {
+		log.Printf("[Video]: Window creation failed, rendering offscreen: %v\n", err)
+		video.Headless = true
+		err = video.openHeadless()
+	}
+	if err != nil {
+		panic(err)
 	}
+	// The buffers of Capture belong to the previous context
+	video.reader = glcapture.Reader{}
 
 	video.Window.MakeContextCurrent()
 
@@ -189,8 +246,13 @@ func (video *Video) Configure(fullscreen bool) {
 
 	video.Window.SetInputMode(glfw.CursorMode, glfw.CursorHidden)
 
-	// Initialize Glow
-	if err := gl.Init(); err != nil {
+	// Initialize Glow, through the offscreen context when headless
+	if window, ok := video.Window.(headlessWindow); ok {
+		err = gl.InitWithProcAddrFunc(window.ProcAddress)
+	} else {
+		err = gl.Init()
+	}
+	if err != nil {
 		panic(err)
 	}
 
@@ -435,6 +497,23 @@ func (video *Video) Render() {
 	gl.UseProgram(0)
 }
 
+// Capture reads back the frame Render just drew, as it would be shown on the
+// window: after the filter shader and with the letterboxing bars. It must be
+// called after Render and before SwapBuffers. The readback is asynchronous,
+// Capture returns the frame of its previous call and nil on the first call.
+// glcapture.I420 converts the frames for video encoders.
+func (video *Video) Capture() *image.RGBA {
+	fbw, fbh := video.Window.GetFramebufferSize()
+	return video.reader.Capture(0, fbw, fbh)
+}
+
+// CaptureSync reads back the frame Render just drew, like Capture, but waits
+// for it. Screenshots and golden image tests want this one.
+func (video *Video) CaptureSync() *image.RGBA {
+	fbw, fbh := video.Window.GetFramebufferSize()
+	return glcapture.CaptureSync(0, fbw, fbh)
+}
+
 // Refresh the texture framebuffer
 func (video *Video) Refresh(data unsafe.Pointer, width int32, height int32, pitch int32) {
 	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
@@ -465,8 +544,12 @@ func (video *Video) CurrentFramebuffer() uintptr {
 	return uintptr(video.fboID)
 }
 
-// ProcAddress returns the address of the proc from GLFW
+// ProcAddress returns the address of the proc from GLFW, or from the
+// offscreen context when headless
 func (video *Video) ProcAddress(procName string) uintptr {
+	if window, ok := video.Window.(headlessWindow); ok {
+		return uintptr(window.ProcAddress(procName))
+	}
 	return uintptr(glfw.GetProcAddress(procName))
 }
 
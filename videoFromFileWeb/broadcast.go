@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	// viewerQueueSize is the number of frames a viewer may lag behind the
+	// broadcast before frames are dropped for it
+	viewerQueueSize = 30
+
+	// maxGOPSize is the number of frames kept since the last keyframe to
+	// serve keyframe requests, a longer group of pictures is not kept
+	maxGOPSize = 300
+
+	// keyframeRequestInterval is the minimum time between two keyframe
+	// requests served to a viewer
+	keyframeRequestInterval = time.Second
+)
+
+// broadcaster reads its playlist once and fans every frame out to all the
+// subscribed viewers. The playlist runs while at least one viewer is
+// subscribed.
+type broadcaster struct {
+	// name identifies the broadcast when a session picks its source
+	name     string
+	playlist *playlist
+	// audio is played along with the playlist, it is nil for video only
+	// broadcasts
+	audio *playlist
+
+	lock    sync.Mutex
+	viewers map[*viewer]struct{}
+	// ctx is the context of the running stream and stop cancels it, both are
+	// nil while the playlist is not read
+	ctx  context.Context
+	stop context.CancelFunc
+	// offset and end keep presentation timestamps increasing when the
+	// playlist is restarted, end is the end of the last frame sent
+	offset time.Duration
+	end    time.Duration
+
+	// seq numbers the frames of the broadcast
+	seq uint64
+	// gop holds the frames since the last keyframe, starting with it. It is
+	// nil before the first keyframe and once the group outgrew maxGOPSize.
+	gop []frame
+}
+
+// frame is a frame of the broadcast along with its presentation timestamp and
+// how long it lasts
+type frame struct {
+	data     []byte
+	pts      time.Duration
+	duration time.Duration
+	keyframe bool
+	seq      uint64
+}
+
+// sampleWriter is the track a viewer receives the broadcast on
+type sampleWriter interface {
+	WriteSample(media.Sample) error
+}
+
+// viewer is a set of tracks subscribed to a broadcaster
+type viewer struct {
+	track  sampleWriter
+	frames chan frame
+	// audioTrack is nil when the viewer does not receive audio
+	audioTrack sampleWriter
+	audio      chan frame
+	// replay receives the frames since the last keyframe when the viewer
+	// asked for a keyframe
+	replay chan []frame
+	// waitKeyframe is set while the viewer cannot decode the broadcast: when
+	// it just joined and after frames were dropped because it lagged behind
+	waitKeyframe bool
+	// lastKeyframeRequest rate limits the keyframe requests of the viewer
+	lastKeyframeRequest time.Time
+}
+
+func newBroadcaster(name string, p, audio *playlist) *broadcaster {
+	return &broadcaster{name: name, playlist: p, audio: audio, viewers: map[*viewer]struct{}{}}
+}
+
+// codec is the video codec of the broadcast
+func (b *broadcaster) codec() Codec {
+	return b.playlist.codec
+}
+
+// subscribe sends the broadcast video on track, starting at the next keyframe,
+// and its audio on audioTrack unless it is nil, until ctx is done. The viewer
+// is returned for its keyframe requests.
+func (b *broadcaster) subscribe(ctx context.Context, track, audioTrack sampleWriter) *viewer {
+	v := &viewer{
+		track:        track,
+		frames:       make(chan frame, viewerQueueSize),
+		audioTrack:   audioTrack,
+		audio:        make(chan frame, viewerQueueSize),
+		replay:       make(chan []frame, 1),
+		waitKeyframe: true,
+	}
+
+	b.lock.Lock()
+	b.viewers[v] = struct{}{}
+	if b.stop == nil {
+		// The stream outlives the session starting it, it stops once the last
+		// viewer left
+		b.ctx, b.stop = context.WithCancel(context.Background())
+		b.offset = b.end
+		go b.run(b.ctx)
+	}
+	b.lock.Unlock()
+
+	go func() {
+		v.run(ctx)
+		b.unsubscribe(v)
+	}()
+	return v
+}
+
+// unsubscribe removes v and stops reading the playlist once nobody watches it
+func (b *broadcaster) unsubscribe(v *viewer) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.viewers, v)
+	if len(b.viewers) == 0 && b.stop != nil {
+		b.stop()
+		b.ctx, b.stop = nil, nil
+	}
+}
+
+func (b *broadcaster) run(ctx context.Context) {
+	// Audio and video share a pacer so that they play in sync
+	clock := newPacer()
+	if b.audio != nil {
+		go b.audio.stream(ctx, b.name, b, clock)
+	}
+	b.playlist.stream(ctx, b.name, b, clock)
+
+	// The playlist ended on its own, the next subscriber restarts it
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.ctx == ctx {
+		b.stop()
+		b.ctx, b.stop = nil, nil
+	}
+}
+
+// requestKeyframe serves a keyframe request of v by sending it, and it alone,
+// the frames of the broadcast since the last keyframe. The other viewers and
+// the playlist are left alone. Without a cached keyframe v waits for the next
+// one. A request less than keyframeRequestInterval after the previous one is
+// ignored, the replay is already on its way.
+func (b *broadcaster) requestKeyframe(v *viewer) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.viewers[v]; !ok || time.Since(v.lastKeyframeRequest) < keyframeRequestInterval {
+		return
+	}
+	v.lastKeyframeRequest = time.Now()
+
+	if b.gop == nil {
+		v.waitKeyframe = true
+		return
+	}
+	// Frames are only ever appended to gop, the viewer can read it unlocked
+	select {
+	case <-v.replay:
+	default:
+	}
+	v.replay <- b.gop[:len(b.gop):len(b.gop)]
+	v.waitKeyframe = false
+}
+
+// handleRTCP serves the PLI and FIR v sends about its track
+func (b *broadcaster) handleRTCP(v *viewer, packet rtcp.Packet) {
+	switch packet.(type) {
+	case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+		b.requestKeyframe(v)
+	}
+}
+
+// writeSample hands a sample of the playlist or of the audio to the viewers
+func (b *broadcaster) writeSample(kind webrtc.RTPCodecType, sample Sample, next time.Duration) error {
+	if kind == webrtc.RTPCodecTypeAudio {
+		return b.writeAudio(sample.Data, sample.PTS, next)
+	}
+	return b.writeFrame(sample.Data, sample.PTS, next, sample.Keyframe)
+}
+
+// writeFrame hands frame to every viewer without ever blocking on one of them.
+// A viewer whose queue is full misses the frame and resumes at the next
+// keyframe.
+func (b *broadcaster) writeFrame(data []byte, pts, next time.Duration, keyframe bool) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.seq++
+	f := frame{data: data, pts: b.offset + pts, duration: next - pts, keyframe: keyframe, seq: b.seq}
+	b.end = b.offset + next
+	switch {
+	case f.keyframe:
+		b.gop = []frame{f}
+	case len(b.gop) >= maxGOPSize:
+		b.gop = nil
+	case b.gop != nil:
+		b.gop = append(b.gop, f)
+	}
+	for v := range b.viewers {
+		if v.waitKeyframe {
+			if !f.keyframe {
+				continue
+			}
+			v.waitKeyframe = false
+		}
+
+		select {
+		case v.frames <- f:
+		default:
+			log.Printf("viewer is lagging behind, dropping frames until the next keyframe\n")
+			v.waitKeyframe = true
+		}
+	}
+	return nil
+}
+
+// writeAudio hands an audio packet to every viewer receiving audio without
+// ever blocking on one of them
+func (b *broadcaster) writeAudio(packet []byte, pts, next time.Duration) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	f := frame{data: packet, pts: b.offset + pts, duration: next - pts}
+	for v := range b.viewers {
+		if v.audioTrack == nil {
+			continue
+		}
+		select {
+		case v.audio <- f:
+		default:
+			log.Printf("viewer is lagging behind, dropping audio\n")
+		}
+	}
+	return nil
+}
+
+// run writes the frames of the broadcast on the viewer tracks as they come
+// until ctx is done. Each frame carries its own duration, which sets the
+// RTP timestamp of the frame after it.
+//
+// A replay is written at once with a single RTP tick per frame, so that the
+// decoder of the viewer catches up with the broadcast while its clock only
+// slips by as many ticks. The queued frames it already covers are skipped.
+func (v *viewer) run(ctx context.Context) {
+	// sent is the sequence number of the last frame written
+	var sent uint64
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case gop := <-v.replay:
+			for _, f := range gop {
+				if err = v.track.WriteSample(media.Sample{Data: f.data, Duration: ticksDuration(1, videoClockRate)}); err != nil {
+					break
+				}
+			}
+			if last := gop[len(gop)-1].seq; last > sent {
+				sent = last
+			}
+		case f := <-v.frames:
+			if f.seq <= sent {
+				continue
+			}
+			err = v.track.WriteSample(media.Sample{Data: f.data, Duration: rtpDuration(f.pts, f.pts+f.duration, videoClockRate)})
+			sent = f.seq
+		case f := <-v.audio:
+			err = v.audioTrack.WriteSample(media.Sample{Data: f.data, Duration: rtpDuration(f.pts, f.pts+f.duration, opusClockRate)})
+		}
+		if err != nil {
+			log.Printf("could not send media: %v\n", err)
+			return
+		}
+	}
+}
+
+// isVP8Keyframe reports whether frame is a VP8 key frame, which is flagged by
+// a cleared bit 0 in the first byte of the frame tag
+func isVP8Keyframe(frame []byte) bool {
+	return len(frame) > 0 && frame[0]&0x01 == 0
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// testTrack records the samples written by a viewer. While blocked is open it
+// stalls every write, like a viewer whose network cannot keep up.
+type testTrack struct {
+	blocked chan struct{}
+
+	lock    sync.Mutex
+	samples []media.Sample
+}
+
+func (t *testTrack) WriteSample(s media.Sample) error {
+	if t.blocked != nil {
+		<-t.blocked
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.samples = append(t.samples, s)
+	return nil
+}
+
+// wait returns the samples of the track once there are n of them
+func (t *testTrack) wait(tb testing.TB, n int) []media.Sample {
+	tb.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		t.lock.Lock()
+		samples := append([]media.Sample(nil), t.samples...)
+		t.lock.Unlock()
+		if len(samples) >= n {
+			return samples
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("received %d samples, expected %d", len(samples), n)
+		}
+	}
+}
+
+// testFrame is the i-th frame of a test broadcast, a VP8 keyframe or
+// interframe according to the frame tag
+func testFrame(i int, keyframe bool) []byte {
+	if keyframe {
+		return []byte{0x00, byte(i)}
+	}
+	return []byte{0x01, byte(i)}
+}
+
+// newTestBroadcaster returns a broadcaster whose frames are written by the
+// test rather than read from a playlist
+func newTestBroadcaster() *broadcaster {
+	return newBroadcaster("test", &playlist{codec: codecVP8}, nil)
+}
+
+// TestBroadcastFanOut checks that every viewer receives every frame as soon as
+// it is written, with the duration of the frame
+func TestBroadcastFanOut(t *testing.T) {
+	b := newTestBroadcaster()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracks := []*testTrack{{}, {}, {}}
+	for _, track := range tracks {
+		b.subscribe(ctx, track, nil)
+	}
+
+	frameDuration := 40 * time.Millisecond
+	for i := 0; i < 10; i++ {
+		pts := time.Duration(i) * frameDuration
+		b.writeFrame(testFrame(i, i == 0), pts, pts+frameDuration, i == 0)
+
+		// The frame is sent without waiting for the next one
+		for n, track := range tracks {
+			samples := track.wait(t, i+1)
+			if got := samples[i].Data[1]; got != byte(i) {
+				t.Fatalf("viewer %d: sample %d holds frame %d", n, i, got)
+			}
+			if samples[i].Duration != frameDuration {
+				t.Errorf("viewer %d: frame %d lasts %v, expected %v", n, i, samples[i].Duration, frameDuration)
+			}
+		}
+	}
+}
+
+// TestBroadcastLateJoiner checks that a viewer joining during the broadcast
+// starts on the next keyframe
+func TestBroadcastLateJoiner(t *testing.T) {
+	b := newTestBroadcaster()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first, late := &testTrack{}, &testTrack{}
+	b.subscribe(ctx, first, nil)
+	keyframes := map[int]bool{0: true, 4: true}
+	for i := 0; i < 6; i++ {
+		if i == 3 {
+			b.subscribe(ctx, late, nil)
+		}
+		b.writeFrame(testFrame(i, keyframes[i]), time.Duration(i)*time.Millisecond, time.Duration(i+1)*time.Millisecond, keyframes[i])
+	}
+
+	first.wait(t, 6)
+	samples := late.wait(t, 2)
+	if len(samples) != 2 || samples[0].Data[1] != 4 || samples[1].Data[1] != 5 {
+		t.Errorf("late viewer received %v, expected frames 4 and 5", samples)
+	}
+}
+
+// TestBroadcastSlowViewer checks that a viewer that cannot keep up does not
+// stall the broadcast nor the other viewers, and that it resumes on a keyframe
+// once its frames were dropped
+func TestBroadcastSlowViewer(t *testing.T) {
+	b := newTestBroadcaster()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fast, slow := &testTrack{}, &testTrack{blocked: make(chan struct{})}
+	b.subscribe(ctx, fast, nil)
+	b.subscribe(ctx, slow, nil)
+
+	// writeFrame must return at once, and the fast viewer keep up with every
+	// frame, whatever the slow viewer does
+	write := func(i int, keyframe bool) {
+		written := make(chan struct{})
+		go func() {
+			b.writeFrame(testFrame(i, keyframe), time.Duration(i)*time.Millisecond, time.Duration(i+1)*time.Millisecond, keyframe)
+			close(written)
+		}()
+		select {
+		case <-written:
+		case <-time.After(time.Second):
+			t.Fatalf("the broadcast stalled on the slow viewer at frame %d", i)
+		}
+		fast.wait(t, i+1)
+	}
+
+	// Enough frames to overflow the queue of the slow viewer: it holds the
+	// frame it is writing and a full queue, the others are dropped
+	overflow := viewerQueueSize + 10
+	for i := 0; i < overflow; i++ {
+		write(i, i == 0)
+	}
+	close(slow.blocked)
+	slow.wait(t, viewerQueueSize+1)
+
+	// Once it caught up it resumes at the next keyframe, skipping the frame
+	// before it
+	write(overflow, false)
+	write(overflow+1, true)
+	write(overflow+2, false)
+	samples := slow.wait(t, viewerQueueSize+3)
+	time.Sleep(10 * time.Millisecond)
+	samples = slow.wait(t, 0)
+	if len(samples) != viewerQueueSize+3 {
+		t.Fatalf("slow viewer received %d frames, expected %d", len(samples), viewerQueueSize+3)
+	}
+	expected := []int{}
+	for i := 0; i <= viewerQueueSize; i++ {
+		expected = append(expected, i)
+	}
+	expected = append(expected, overflow+1, overflow+2)
+	for n, i := range expected {
+		if got := samples[n].Data[1]; got != byte(i) {
+			t.Errorf("slow viewer sample %d holds frame %d, expected %d", n, got, i)
+		}
+	}
+}
+
+// TestBroadcastKeyframeRequest checks that a keyframe request is served to the
+// viewer that made it by replaying the frames since the last keyframe, without
+// touching the broadcast of the other viewers
+func TestBroadcastKeyframeRequest(t *testing.T) {
+	b := newTestBroadcaster()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requesting, other := &testTrack{}, &testTrack{}
+	v := b.subscribe(ctx, requesting, nil)
+	b.subscribe(ctx, other, nil)
+
+	frameDuration := 40 * time.Millisecond
+	write := func(i int) {
+		pts := time.Duration(i) * frameDuration
+		b.writeFrame(testFrame(i, i == 0), pts, pts+frameDuration, i == 0)
+	}
+	for i := 0; i < 3; i++ {
+		write(i)
+	}
+	requesting.wait(t, 3)
+
+	b.requestKeyframe(v)
+	// A second request right away is served by the same replay
+	b.requestKeyframe(v)
+	samples := requesting.wait(t, 6)
+	for n, i := range []int{0, 1, 2} {
+		if s := samples[3+n]; s.Data[1] != byte(i) || s.Duration != ticksDuration(1, videoClockRate) {
+			t.Errorf("replayed sample %d holds frame %d lasting %v, expected frame %d lasting a single RTP tick", n, s.Data[1], s.Duration, i)
+		}
+	}
+
+	write(3)
+	samples = requesting.wait(t, 7)
+	if s := samples[6]; s.Data[1] != 3 || s.Duration != frameDuration {
+		t.Errorf("after the replay received frame %d lasting %v, expected frame 3 lasting %v", s.Data[1], s.Duration, frameDuration)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if samples = requesting.wait(t, 0); len(samples) != 7 {
+		t.Errorf("requesting viewer received %d samples, expected 7", len(samples))
+	}
+	if samples = other.wait(t, 4); len(samples) != 4 {
+		t.Errorf("other viewer received %d samples, expected the 4 frames of the broadcast", len(samples))
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"time"
+)
+
+// h264FrameRate is the frame rate H.264 files are played at, Annex-B streams
+// carry no timestamps
+var h264FrameRate = 30
+
+// H.264 NAL unit types
+const (
+	nalSlice = 1
+	nalIDR   = 5
+	nalSEI   = 6
+	nalSPS   = 7
+	nalPPS   = 8
+	nalAUD   = 9
+)
+
+// annexBStartCode is written before every NAL unit of an access unit
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// h264Reader reads the access units of an H.264 Annex-B stream. The SPS and
+// PPS last seen are repeated before every IDR picture that lacks them, so
+// that a viewer can start decoding at any keyframe.
+type h264Reader struct {
+	r *bufio.Reader
+	// started is set once the first start code was read
+	started bool
+	// next is a NAL unit read ahead that begins the next access unit
+	next []byte
+
+	sps, pps []byte
+	// frames is the number of access units read so far
+	frames uint64
+}
+
+func newH264Reader(r io.Reader) *h264Reader {
+	return &h264Reader{r: bufio.NewReader(r)}
+}
+
+// timebase is the duration of a frame, the timestamps returned by nextFrame
+// count frames
+func (h *h264Reader) timebase() time.Duration {
+	return time.Second / time.Duration(h264FrameRate)
+}
+
+// nextFrame returns the next access unit in Annex-B format along with its
+// frame number
+func (h *h264Reader) nextFrame() ([]byte, uint64, error) {
+	var au []byte
+	var hasVCL, hasSPS, hasPPS bool
+	for {
+		nal := h.next
+		h.next = nil
+		if nal == nil {
+			var err error
+			if nal, err = h.readNAL(); err == io.EOF && hasVCL {
+				break
+			} else if err != nil {
+				return nil, 0, err
+			}
+		}
+
+		nalType := nal[0] & 0x1f
+		if hasVCL && startsAccessUnit(nal) {
+			h.next = nal
+			break
+		}
+
+		switch nalType {
+		case nalSPS:
+			h.sps, hasSPS = nal, true
+		case nalPPS:
+			h.pps, hasPPS = nal, true
+		case nalIDR:
+			if !hasSPS && h.sps != nil {
+				au = append(append(au, annexBStartCode...), h.sps...)
+			}
+			if !hasPPS && h.pps != nil {
+				au = append(append(au, annexBStartCode...), h.pps...)
+			}
+			hasSPS, hasPPS = true, true
+		}
+		if nalType >= nalSlice && nalType <= nalIDR {
+			hasVCL = true
+		}
+		au = append(append(au, annexBStartCode...), nal...)
+	}
+
+	frame := h.frames
+	h.frames++
+	return au, frame, nil
+}
+
+// readNAL returns the next NAL unit of the stream without its start code
+func (h *h264Reader) readNAL() ([]byte, error) {
+	var nal []byte
+	zeros := 0
+	for {
+		b, err := h.r.ReadByte()
+		if err == io.EOF && h.started && len(nal) > 0 {
+			// Trailing zero bytes are not part of the NAL unit
+			return nal, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case b == 0x00:
+			zeros++
+			continue
+		case b == 0x01 && zeros >= 2:
+			zeros = 0
+			if h.started && len(nal) > 0 {
+				return nal, nil
+			}
+			// Anything before the first start code is garbage
+			h.started = true
+			nal = nil
+			continue
+		}
+		for ; zeros > 0; zeros-- {
+			nal = append(nal, 0x00)
+		}
+		nal = append(nal, b)
+	}
+}
+
+// startsAccessUnit reports whether nal begins a new access unit when it
+// follows a picture
+func startsAccessUnit(nal []byte) bool {
+	switch nal[0] & 0x1f {
+	case nalAUD, nalSPS, nalPPS, nalSEI, 14, 15, 16, 17, 18:
+		return true
+	case nalSlice, nalIDR:
+		// The first slice of a picture has first_mb_in_slice 0, whose
+		// Exp-Golomb code is a single set bit
+		return len(nal) > 1 && nal[1]&0x80 != 0
+	}
+	return false
+}
+
+// isH264Keyframe reports whether the Annex-B access unit au holds an IDR
+// picture
+func isH264Keyframe(au []byte) bool {
+	for i := 0; i+3 < len(au); i++ {
+		if au[i] == 0x00 && au[i+1] == 0x00 && au[i+2] == 0x01 && au[i+3]&0x1f == nalIDR {
+			return true
+		}
+	}
+	return false
+}
@@ -1,31 +1,122 @@
- package main
-
- import (
-	 "encoding/base64"
-	 "encoding/json"
-	 "fmt"
-	 "github.com/pion/webrtc"
-	 "github.com/pion/webrtc/pkg/media"
-	 "github.com/pion/webrtc/pkg/media/ivfreader"
-	 "html/template"
-	 "io"
-	 "io/ioutil"
-	 "log"
-	 "math/rand"
-	 "net/http"
-	 "os"
-	 "sync"
-	 "time"
- )
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jtestard/tinygo-webrtc/rtcconfig"
+	"github.com/jtestard/tinygo-webrtc/rtcsession"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// broadcasts holds the broadcasts a session can pick from by name. Each reads
+// its playlist once and sends it to every session watching it. When a session
+// does not pick one the first broadcast whose codec is in the offer is used.
+var broadcasts []*broadcaster
+
+// rtcConfig holds the listen address and the ICE settings of the server
+var rtcConfig *rtcconfig.Config
 
 func main() {
-	// Block forever
-	http.HandleFunc("/", getWeb)
-	http.HandleFunc("/webrtc/open", startWebRTCSession)
-	http.HandleFunc("/webrtc/close", closeWebRTCSession)
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-	fmt.Println("now serving on localhost:8000")
-	checkNoError(http.ListenAndServe(":8000", nil))
+	loadConfig := rtcconfig.Flags(flag.CommandLine)
+	playlistFlag := flag.String("playlist", defaultPlaylist, "comma separated list of IVF files to stream")
+	h264Flag := flag.String("h264", "", "comma separated list of H.264 Annex-B files to stream to peers that prefer H.264 or lack VP8")
+	flag.IntVar(&h264FrameRate, "h264-fps", h264FrameRate, "frame rate of the H.264 files")
+	loop := flag.Bool("loop", false, "restart the playlist once its last file was sent")
+	audioFlag := flag.String("audio", "", "Ogg/Opus file to play along with the playlist")
+	pattern := flag.Bool("pattern", false, "stream a generated test pattern, which needs no media file")
+	patternSize := flag.String("pattern-size", "640x360", "frame size of the test pattern")
+	patternFPS := flag.Int("pattern-fps", 30, "frame rate of the test pattern")
+	flag.Parse()
+	var err error
+	rtcConfig, err = loadConfig()
+	checkNoError(err)
+	checkNoError(rtcConfig.Open())
+
+	// The default playlist is only streamed when there is nothing else to
+	// stream and the file is there, so that the server runs with no assets
+	if !flagSet("playlist") && (*pattern || !fileExists(defaultPlaylist)) {
+		*playlistFlag = ""
+	}
+
+	var audio *playlist
+	if *audioFlag != "" {
+		audio, err = newFilePlaylist(*audioFlag, *loop)
+		checkNoError(err)
+	}
+	addFileBroadcast("playlist", *playlistFlag, audio, *loop)
+	addFileBroadcast("h264", *h264Flag, audio, *loop)
+	if *pattern {
+		p, err := newPatternPlaylist(*patternSize, *patternFPS)
+		checkNoError(err)
+		broadcasts = append(broadcasts, newBroadcaster("pattern", p, audio))
+	}
+	if len(broadcasts) == 0 {
+		log.Fatalf("nothing to stream: %s not found, pass -playlist, -h264 or -pattern\n", defaultPlaylist)
+	}
+
+	fmt.Printf("now serving on %s\n", rtcConfig.Listen)
+	err = rtcsession.Serve(rtcConfig.Listen, newHandler(), sessions)
+	rtcConfig.Close()
+	checkNoError(err)
+}
+
+// defaultPlaylist is streamed when no source is given on the command line
+const defaultPlaylist = "output.ivf"
+
+// flagSet reports whether the flag name was passed on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// addFileBroadcast adds a broadcast of the comma separated list of media files,
+// nothing is added when the list is empty
+func addFileBroadcast(name, files string, audio *playlist, loop bool) {
+	if files == "" {
+		return
+	}
+	p, err := newFilePlaylist(files, loop)
+	checkNoError(err)
+	broadcasts = append(broadcasts, newBroadcaster(name, p, audio))
+}
+
+// newHandler routes the requests of the server, tests serve it with httptest
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", getWeb)
+	mux.HandleFunc("/webrtc/open", startWebRTCSession)
+	mux.HandleFunc("/webrtc/close", closeWebRTCSession)
+	mux.HandleFunc("/webrtc/sources", listSources)
+	mux.HandleFunc("/webrtc/ws", websocketSession)
+	mux.HandleFunc("/webrtc/stats", rtcsession.StatsHandler(sessions))
+	mux.HandleFunc("/webrtc/config", getConfig)
+	mux.Handle("/metrics", rtcsession.MetricsHandler)
+	mux.HandleFunc(whepPath, whepHandler)
+	mux.HandleFunc(whepPath+"/", whepHandler)
+	mux.Handle("/static/stats.js", rtcsession.StatsScript)
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	return mux
 }
 
 func checkNoError(err error) {
@@ -38,131 +129,227 @@ func checkNoError(err error) {
 func getWeb(w http.ResponseWriter, r *http.Request) {
 	tmpl, err := template.ParseFiles("demo.html")
 	if err != nil {
-		log.Fatal(err)
+		rtcsession.WriteError(w, rtcsession.ErrInternal(err))
+		return
 	}
 
-	tmpl.Execute(w, nil)
+	tmpl.Execute(w, rtcConfig.Frontend())
+}
+
+// getConfig returns the configuration the browser must create its peer
+// connection with
+func getConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rtcConfig.Frontend()); err != nil {
+		log.Printf("could not send configuration: %v\n", err)
+	}
 }
 
-var peerConnection *webrtc.PeerConnection
-var lock sync.Mutex
+// sessions are the open sessions, by ID
+var sessions = rtcsession.NewRegistry()
+
+// sessionResponse is returned by /webrtc/open. The ID must be passed back to /webrtc/close
+type sessionResponse struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+}
 
 func closeWebRTCSession(w http.ResponseWriter, r *http.Request) {
-	if peerConnection == nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("session already closed/never opened"))
+	id := r.URL.Query().Get("id")
+	s := sessions.Remove(id)
+	if s == nil {
+		rtcsession.WriteError(w, rtcsession.ErrSessionNotFound(id))
+		return
+	}
+	if err := s.Close(); err != nil {
+		rtcsession.WriteError(w, rtcsession.ErrInternal(err))
 		return
 	}
-	checkNoError(peerConnection.Close())
-	peerConnection = nil
+	fmt.Printf("session %s closed\n", s.ID)
 }
 
-
 func startWebRTCSession(w http.ResponseWriter, r *http.Request) {
-	if peerConnection != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("session already started. Please close before re-opening"))
-		return
-	}
+	start := time.Now()
+	var err error
+	defer func() { rtcsession.ObserveOpen("open", start, err) }()
 
-	// Everything below is the Pion WebRTC API! Thanks for using it ❤️.
 	buf, err := ioutil.ReadAll(r.Body)
-	checkNoError(err)
+	if err != nil {
+		err = rtcsession.ErrBadOffer(err)
+		rtcsession.WriteError(w, err)
+		return
+	}
 
 	// The mirrorweb rtc offer is sent over in the body of the request
 	offer := webrtc.SessionDescription{}
-	decode(string(buf), &offer)
-
-	// We make our own mediaEngine so we can place the sender's codecs in it. Since we are echoing their RTP packet
-	// back to them we are actually codec agnostic - we can accept all their codecs. This also ensures that we use the
-	// dynamic media type from the sender in our answer.
-	mediaEngine := webrtc.MediaEngine{}
-
-	// Add codecs to the mediaEngine. Note that even though we are only going to echo back the sender's video we also
-	// add audio codecs. This is because createAnswer will create an audioTransceiver and associated SDP and we currently
-	// cannot tell it not to. The audio SDP must match the sender's codecs too...
-	err = mediaEngine.PopulateFromSDP(offer)
-	checkNoError(err)
+	if err = decode(string(buf), &offer); err != nil {
+		err = rtcsession.ErrBadOffer(err)
+		rtcsession.WriteError(w, err)
+		return
+	}
 
-	// Search for VP8 Payload type. If the offer doesn't support VP8 exit since
-	// since they won't be able to decode anything we send them
-	var payloadType uint8
-	for _, videoCodec := range mediaEngine.GetCodecsByKind(webrtc.RTPCodecTypeVideo) {
-		if videoCodec.Name == "VP8" {
-			payloadType = videoCodec.PayloadType
-			break
-		}
+	s, answer, err := openSession(offer, r.URL.Query().Get("source"), nil)
+	if err != nil {
+		rtcsession.WriteError(w, err)
+		return
 	}
-	if payloadType == 0 {
-		panic("Remote peer does not support VP8")
+
+	// return the session ID and the answer in base64 to the browser
+	w.Header().Set("Content-Type", "application/json")
+	if encodeErr := json.NewEncoder(w).Encode(sessionResponse{ID: s.ID, Description: encode(answer)}); encodeErr != nil {
+		log.Printf("session %s: could not send response: %v\n", s.ID, encodeErr)
+		return
 	}
+	fmt.Printf("session %s: response sent to browser\n", s.ID)
 
-	// Create a new RTCPeerConnection
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
-	peerConnection, err = api.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	})
-	checkNoError(err)
+	// print the answer to the logs
+	fmt.Println(encode(answer))
+}
 
-	// Create a video track
-	videoTrack, err := peerConnection.NewTrack(payloadType, rand.Uint32(), "video", "pion")
-	checkNoError(err)
-	_, err = peerConnection.AddTrack(videoTrack)
-	checkNoError(err)
+// websocketSession serves the signaling WebSocket, the source to stream is
+// picked with ?source=<name> as on /webrtc/open
+func websocketSession(w http.ResponseWriter, r *http.Request) {
+	source := r.URL.Query().Get("source")
+	rtcsession.WebSocketHandler(sessions, func(offer webrtc.SessionDescription, onCandidate func(*webrtc.ICECandidate)) (*rtcsession.Session, webrtc.SessionDescription, error) {
+		return openSession(offer, source, onCandidate)
+	})(w, r)
+}
 
-	go func() {
-		// Open a IVF file and start reading using our IVFReader
-		file, ivfErr := os.Open("output.ivf")
-		checkNoError(ivfErr)
+// openSession creates the peer connection streaming the broadcast named source
+// for offer and registers it. Any broadcast the offer can decode is picked
+// when source is empty. When onCandidate is set the local candidates are
+// trickled to it instead of being gathered into the answer. On failure the
+// peer connection is closed so that no half-initialised session is left
+// behind.
+func openSession(offer webrtc.SessionDescription, source string, onCandidate func(*webrtc.ICECandidate)) (s *rtcsession.Session, answer webrtc.SessionDescription, err error) {
+	// Everything below is the Pion WebRTC API! Thanks for using it ❤️.
 
-		ivf, header, ivfErr := ivfreader.NewWith(file)
-		checkNoError(ivfErr)
+	// We make our own mediaEngine so we can place the viewer's codecs in it. This ensures that we use the dynamic
+	// payload types of the viewer in our answer.
+	mediaEngine := &webrtc.MediaEngine{}
 
-		// Send our video file frame at a time. Pace our sending so we send it at the same speed it should be played back as.
-		// This isn't required since the video is timestamped, but we will such much higher loss if we send all at once.
-		sleepTime := time.Millisecond * time.Duration((float32(header.TimebaseNumerator)/float32(header.TimebaseDenominator))*1000)
-		for {
-			frame, _, ivfErr := ivf.ParseNextFrame()
-			if ivfErr == io.EOF {
-				break
+	// Add the codecs of the offer to the mediaEngine, audio included so that
+	// the audio track uses the Opus payload type of the viewer
+	offered := map[webrtc.RTPCodecType][]webrtc.RTPCodecParameters{}
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if offered[kind], err = rtcsession.OfferedCodecs(offer, kind); err != nil {
+			return nil, answer, err
+		}
+		for _, codec := range offered[kind] {
+			if err = mediaEngine.RegisterCodec(codec, kind); err != nil {
+				return nil, answer, rtcsession.ErrInternal(err)
 			}
-			checkNoError(ivfErr)
+		}
+	}
 
-			time.Sleep(sleepTime)
-			ivfErr = videoTrack.WriteSample(media.Sample{Data: frame, Samples: 90000})
-			checkNoError(ivfErr)
+	// Pick the first codec of the offer we have a broadcast for, codecs are
+	// listed in order of preference. Exit if there is none since they won't be
+	// able to decode anything we send them
+	candidates := broadcasts
+	if source != "" {
+		b := findBroadcast(source)
+		if b == nil {
+			return nil, answer, rtcsession.ErrSourceNotFound(source)
+		}
+		candidates = []*broadcaster{b}
+	}
+	codec, broadcast := selectBroadcast(offered[webrtc.RTPCodecTypeVideo], candidates)
+	if broadcast == nil {
+		return nil, answer, rtcsession.ErrUnsupportedCodec("remote peer does not support %s", broadcastCodecs(candidates))
+	}
+
+	// Create a new RTCPeerConnection with the configured ICE servers and ports
+	pc, err := rtcConfig.NewPeerConnection(mediaEngine)
+	if err != nil {
+		return nil, answer, rtcsession.ErrInternal(err)
+	}
+	sess := sessions.New(pc)
+	defer func() {
+		if err != nil {
+			sess.Abort()
 		}
 	}()
 
+	// Create a video track, the session sends the sender reports about it
+	track, err := webrtc.NewTrackLocalStaticRTP(codec.RTPCodecCapability, "video", "pion")
+	if err != nil {
+		return nil, answer, rtcsession.ErrInternal(err)
+	}
+	videoTrack, sender, err := sess.AddTrack(track)
+	if err != nil {
+		return nil, answer, rtcsession.ErrInternal(err)
+	}
+
+	// Create an audio track when the broadcast has audio the viewer can decode,
+	// otherwise the session is video only
+	var audioTrack sampleWriter
+	if broadcast.audio != nil {
+		var audioCodec *webrtc.RTPCodecParameters
+		for i, c := range offered[webrtc.RTPCodecTypeAudio] {
+			if strings.EqualFold(c.MimeType, broadcast.audio.codec.MimeType()) {
+				audioCodec = &offered[webrtc.RTPCodecTypeAudio][i]
+				break
+			}
+		}
+		if audioCodec == nil {
+			log.Printf("remote peer does not support %s, sending video only\n", broadcast.audio.codec.Name)
+		} else {
+			track, err := webrtc.NewTrackLocalStaticRTP(audioCodec.RTPCodecCapability, "audio", "pion")
+			if err != nil {
+				return nil, answer, rtcsession.ErrInternal(err)
+			}
+			reported, audioSender, err := sess.AddTrack(track)
+			if err != nil {
+				return nil, answer, rtcsession.ErrInternal(err)
+			}
+			go sess.RTCP.ReadRTCP(audioSender, nil)
+			audioTrack = reported
+		}
+	}
+
 	// Set the handler for ICE connection state
 	// This will notify you when the peer has connected/disconnected
-	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		fmt.Printf("Connection State has changed %s \n", connectionState.String())
+		sess.WatchICE(connectionState)
 	})
 
 	// Set the remote SessionDescription
-	err = peerConnection.SetRemoteDescription(offer)
-	checkNoError(err)
+	if err = pc.SetRemoteDescription(offer); err != nil {
+		return nil, answer, rtcsession.ErrBadOffer(err)
+	}
+
+	// Without trickle the answer lists every candidate, it is only complete once
+	// gathering is
+	var gathered <-chan struct{}
+	if onCandidate != nil {
+		pc.OnICECandidate(onCandidate)
+	} else {
+		gathered = webrtc.GatheringCompletePromise(pc)
+	}
 
 	// Create an answer
-	answer, err := peerConnection.CreateAnswer(nil)
-	checkNoError(err)
+	answer, err = pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, answer, rtcsession.ErrInternal(err)
+	}
 
 	// Sets the LocalDescription, and starts our UDP listeners
-	err = peerConnection.SetLocalDescription(answer)
-	checkNoError(err)
+	if err = pc.SetLocalDescription(answer); err != nil {
+		return nil, answer, rtcsession.ErrInternal(err)
+	}
+	if gathered != nil {
+		<-gathered
+		answer = *pc.LocalDescription()
+	}
 
-	// return the answer to the browser in base64
-	_, err = w.Write([]byte(encode(answer)))
-	checkNoError(err)
-	fmt.Println("response sent to browser")
+	// Every session watching this source shares the same broadcast until it is
+	// closed, keyframe requests of the viewer are served from the frames it keeps
+	v := broadcast.subscribe(sess.Context(), videoTrack, audioTrack)
+	go sess.RTCP.ReadRTCP(sender, func(packet rtcp.Packet) { broadcast.handleRTCP(v, packet) })
 
-	// print the answer to the logs
-	fmt.Println(encode(answer))
+	// Register the session so that it can be closed later on
+	return sessions.Add(sess), answer, nil
 }
 
 // Encode encodes the input in base64
@@ -178,14 +365,71 @@ func encode(obj interface{}) string {
 
 // Decode decodes the input from base64
 // It can optionally unzip the input after decoding
-func decode(in string, obj interface{}) {
+func decode(in string, obj interface{}) error {
 	b, err := base64.StdEncoding.DecodeString(in)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	err = json.Unmarshal(b, obj)
-	if err != nil {
-		panic(err)
+	return json.Unmarshal(b, obj)
+}
+
+// selectBroadcast returns the first of candidates whose codec is in codecs,
+// along with the codec. codecs are tried in order.
+func selectBroadcast(codecs []webrtc.RTPCodecParameters, candidates []*broadcaster) (webrtc.RTPCodecParameters, *broadcaster) {
+	for _, codec := range codecs {
+		// Our H.264 packetizer fragments NAL units, which packetization mode 0
+		// does not allow
+		if strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264) && !strings.Contains(codec.SDPFmtpLine, "packetization-mode=1") {
+			continue
+		}
+		for _, b := range candidates {
+			if strings.EqualFold(b.codec().MimeType(), codec.MimeType) {
+				return codec, b
+			}
+		}
+	}
+	return webrtc.RTPCodecParameters{}, nil
+}
+
+// findBroadcast returns the broadcast called name, or nil if there is none
+func findBroadcast(name string) *broadcaster {
+	for _, b := range broadcasts {
+		if b.name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// broadcastCodecs lists the video codecs of candidates
+func broadcastCodecs(candidates []*broadcaster) string {
+	var codecs []string
+	seen := map[string]bool{}
+	for _, b := range candidates {
+		if name := b.codec().Name; !seen[name] {
+			seen[name] = true
+			codecs = append(codecs, name)
+		}
+	}
+	return strings.Join(codecs, " or ")
+}
+
+// sourceInfo describes a broadcast in the /webrtc/sources listing
+type sourceInfo struct {
+	Name  string `json:"name"`
+	Codec string `json:"codec"`
+	Audio bool   `json:"audio"`
+}
+
+// listSources returns the broadcasts a session can pick with ?source=<name>
+func listSources(w http.ResponseWriter, r *http.Request) {
+	list := []sourceInfo{}
+	for _, b := range broadcasts {
+		list = append(list, sourceInfo{Name: b.name, Codec: b.codec().Name, Audio: b.audio != nil})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		log.Printf("could not send source list: %v\n", err)
 	}
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// oggPageHeaderSize is the size of the fixed part of an Ogg page header, the
+// segment table follows
+const oggPageHeaderSize = 27
+
+var errNotOgg = errors.New("not an Ogg stream")
+
+// oggReader reads the packets of the first logical stream of an Ogg file. A
+// page holds several packets, its segment table gives their sizes: a packet is
+// made of segments of 255 bytes up to a shorter one, and continues on the next
+// page when the last segment of a page is 255 bytes long.
+type oggReader struct {
+	r *bufio.Reader
+	// serial identifies the stream read, pages of other streams are skipped
+	serial  uint32
+	started bool
+
+	// segments and data are what is left of the current page
+	segments []byte
+	data     []byte
+	// partial is the start of a packet continued on the next page
+	partial []byte
+}
+
+func newOggReader(r io.Reader) *oggReader {
+	return &oggReader{r: bufio.NewReader(r)}
+}
+
+// nextPacket returns the next packet of the stream
+func (o *oggReader) nextPacket() ([]byte, error) {
+	for {
+		if len(o.segments) == 0 {
+			if err := o.readPage(); err != nil {
+				if err == io.EOF && len(o.partial) > 0 {
+					return nil, io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			continue
+		}
+
+		size := 0
+		complete := false
+		for len(o.segments) > 0 {
+			lacing := int(o.segments[0])
+			o.segments = o.segments[1:]
+			size += lacing
+			if lacing < 255 {
+				complete = true
+				break
+			}
+		}
+		if size > len(o.data) {
+			return nil, errors.New("Ogg page shorter than its segment table")
+		}
+		o.partial = append(o.partial, o.data[:size]...)
+		o.data = o.data[size:]
+		if complete {
+			packet := o.partial
+			o.partial = nil
+			return packet, nil
+		}
+	}
+}
+
+// readPage reads the next page of the stream into segments and data
+func (o *oggReader) readPage() error {
+	for {
+		header := make([]byte, oggPageHeaderSize)
+		if _, err := io.ReadFull(o.r, header); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return fmt.Errorf("truncated Ogg page: %w", err)
+			}
+			return err
+		}
+		if !bytes.Equal(header[:4], []byte("OggS")) {
+			return errNotOgg
+		}
+		serial := binary.LittleEndian.Uint32(header[14:])
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(o.r, segments); err != nil {
+			return fmt.Errorf("truncated Ogg page: %w", err)
+		}
+		size := 0
+		for _, lacing := range segments {
+			size += int(lacing)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(o.r, data); err != nil {
+			return fmt.Errorf("truncated Ogg page: %w", err)
+		}
+
+		if !o.started {
+			o.started, o.serial = true, serial
+		} else if serial != o.serial {
+			continue
+		}
+		o.segments, o.data = segments, data
+		return nil
+	}
+}
+
+// opusHeadSize is the size of the OpusHead packet of a mono or stereo stream,
+// the channel mapping of more channels follows
+const opusHeadSize = 19
+
+// parseOpusHead returns the pre-skip of an OpusHead packet, the number of
+// samples to drop from the start of the decoded stream
+func parseOpusHead(packet []byte) (preSkip int, err error) {
+	if len(packet) < opusHeadSize || !bytes.HasPrefix(packet, []byte("OpusHead")) {
+		return 0, errors.New("Ogg stream does not start with an OpusHead packet")
+	}
+	return int(binary.LittleEndian.Uint16(packet[10:])), nil
+}
+
+// opusPacketSamples returns the number of samples at 48 kHz in an Opus packet,
+// from its TOC byte: the configuration gives the duration of a frame and the
+// code the number of frames (RFC 6716 section 3.1)
+func opusPacketSamples(packet []byte) (int, error) {
+	if len(packet) == 0 {
+		return 0, errors.New("empty Opus packet")
+	}
+	toc := packet[0]
+	config := int(toc >> 3)
+	var frameSamples int
+	switch {
+	case config < 12:
+		// SILK: 10, 20, 40 or 60 ms
+		frameSamples = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		// Hybrid: 10 or 20 ms
+		frameSamples = []int{480, 960}[config%2]
+	default:
+		// CELT: 2.5, 5, 10 or 20 ms
+		frameSamples = []int{120, 240, 480, 960}[config%4]
+	}
+
+	frames := 1
+	switch toc & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, errors.New("Opus packet without frame count")
+		}
+		frames = int(packet[1] & 0x3f)
+	}
+	return frames * frameSamples, nil
+}
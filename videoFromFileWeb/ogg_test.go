@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// oggPage builds an Ogg page of the stream serial holding segments, the
+// lacing values of its segment table
+func oggPage(serial uint32, segments []byte, data []byte) []byte {
+	header := make([]byte, oggPageHeaderSize)
+	copy(header, "OggS")
+	binary.LittleEndian.PutUint32(header[14:], serial)
+	header[26] = byte(len(segments))
+	page := append(header, segments...)
+	return append(page, data...)
+}
+
+// opusPacket returns a CELT packet of a single 2.5 ms frame, 120 samples,
+// padded to size bytes
+func opusPacket(size int, fill byte) []byte {
+	packet := bytes.Repeat([]byte{fill}, size)
+	packet[0] = 16 << 3
+	return packet
+}
+
+// TestOggSource reads packets split across and packed within pages, and
+// checks the pre-skip packets are dropped and the timestamps follow the
+// packet durations
+func TestOggSource(t *testing.T) {
+	head := make([]byte, opusHeadSize)
+	copy(head, "OpusHead")
+	head[8] = 2                                   // channels
+	binary.LittleEndian.PutUint16(head[10:], 250) // pre-skip, two 120 sample packets and a bit
+	tags := []byte("OpusTags")
+
+	var stream []byte
+	stream = append(stream, oggPage(1, []byte{byte(len(head))}, head)...)
+	stream = append(stream, oggPage(1, []byte{byte(len(tags))}, tags)...)
+	// Another stream is ignored
+	stream = append(stream, oggPage(2, []byte{3}, opusPacket(3, 0xee))...)
+	// Four packets in a page, the last one continued on the next page
+	packets := [][]byte{opusPacket(10, 1), opusPacket(20, 2), opusPacket(30, 3), opusPacket(300, 4)}
+	var data []byte
+	for _, p := range packets {
+		data = append(data, p...)
+	}
+	stream = append(stream, oggPage(1, []byte{10, 20, 30, 255}, data[:315])...)
+	stream = append(stream, oggPage(1, []byte{45}, data[315:])...)
+
+	s, err := newOggSource(ioutil.NopCloser(bytes.NewReader(stream)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range packets[2:] {
+		sample, err := s.NextSample()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sample.Data, p) {
+			t.Errorf("sample %d is %d bytes of %d, expected packet %d", i, len(sample.Data), sample.Data[1], i+2)
+		}
+		if pts := time.Duration(i) * 2500 * time.Microsecond; sample.PTS != pts {
+			t.Errorf("sample %d has PTS %s, expected %s", i, sample.PTS, pts)
+		}
+	}
+	if _, err = s.NextSample(); err != io.EOF {
+		t.Errorf("got %v at the end of the stream, expected EOF", err)
+	}
+}
+
+func TestOpusPacketSamples(t *testing.T) {
+	for _, test := range []struct {
+		packet  []byte
+		samples int
+	}{
+		{[]byte{1 << 3}, 960},              // SILK 20 ms
+		{[]byte{3<<3 | 1, 0}, 2 * 2880},    // SILK 60 ms, two frames
+		{[]byte{13 << 3}, 960},             // Hybrid 20 ms
+		{[]byte{31<<3 | 3, 3}, 3 * 960},    // CELT 20 ms, three frames
+		{[]byte{16<<3 | 2, 0, 0}, 2 * 120}, // CELT 2.5 ms, two frames
+	} {
+		samples, err := opusPacketSamples(test.packet)
+		if err != nil || samples != test.samples {
+			t.Errorf("TOC %#x: got %d samples (err %v), expected %d", test.packet[0], samples, err, test.samples)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// videoClockRate is the RTP clock rate of video tracks
+	videoClockRate = 90000
+	// opusClockRate is the RTP clock rate of Opus, the durations of Opus
+	// packets count samples at the same rate
+	opusClockRate = 48000
+
+	// maxLateness bounds how far behind the wall clock the stream may fall. When
+	// a frame is later than this the clock is shifted instead of bursting frames
+	// out to catch up.
+	maxLateness = 500 * time.Millisecond
+)
+
+// pacer schedules frames from their presentation timestamp against a monotonic
+// wall clock. Frames are due at start + pts so that timing errors do not
+// accumulate from one frame to the next. The video and audio of a broadcast
+// share a pacer, which keeps them in sync.
+type pacer struct {
+	now func() time.Time
+
+	lock  sync.Mutex
+	start time.Time
+}
+
+func newPacer() *pacer {
+	return &pacer{now: time.Now}
+}
+
+// wait blocks until the frame presented at pts is due, or until ctx is done
+// in which case it returns false. It returns how late the frame is.
+func (p *pacer) wait(ctx context.Context, pts time.Duration) (time.Duration, bool) {
+	p.lock.Lock()
+	now := p.now()
+	if p.start.IsZero() {
+		p.start = now.Add(-pts)
+	}
+
+	// time.Time keeps the monotonic clock reading of time.Now, the
+	// difference is not affected by wall clock changes
+	delay := p.start.Add(pts).Sub(now)
+	if delay <= 0 {
+		late := -delay
+		if late > maxLateness {
+			p.start = p.start.Add(late)
+		}
+		p.lock.Unlock()
+		return late, true
+	}
+	p.lock.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return 0, false
+	case <-timer.C:
+		return 0, true
+	}
+}
+
+// rtpSamples returns the number of ticks of an RTP clock running at clockRate
+// between two presentation timestamps. Converting both timestamps rather than
+// their difference keeps rounding errors from adding up over a long stream.
+func rtpSamples(from, to time.Duration, clockRate uint64) uint32 {
+	return uint32(rtpTime(to, clockRate) - rtpTime(from, clockRate))
+}
+
+// rtpDuration returns the duration of the RTP ticks between two presentation
+// timestamps, as counted by rtpSamples. Tracks turn a sample duration back into
+// as many ticks.
+func rtpDuration(from, to time.Duration, clockRate uint64) time.Duration {
+	return ticksDuration(rtpSamples(from, to, clockRate), clockRate)
+}
+
+// ticksDuration returns the duration of ticks of an RTP clock running at
+// clockRate
+func ticksDuration(ticks uint32, clockRate uint64) time.Duration {
+	return time.Duration(uint64(ticks) * uint64(time.Second) / clockRate)
+}
+
+func rtpTime(pts time.Duration, clockRate uint64) uint64 {
+	return uint64(pts/time.Microsecond) * clockRate / uint64(time.Second/time.Microsecond)
+}
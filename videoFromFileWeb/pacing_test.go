@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeClock is the clock of a pacer under test, the wakeups of the streaming
+// goroutine are simulated by setting it
+type fakeClock struct {
+	now time.Time
+}
+
+func newTestPacer() (*pacer, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	p := newPacer()
+	p.now = func() time.Time { return clock.now }
+	return p, clock
+}
+
+// send simulates the streaming goroutine waking up at wakeup to send the frame
+// presented at pts, and returns when the frame is sent and how late it is. An
+// early wakeup sleeps until the frame is due, a late one sends it right away.
+func (c *fakeClock) send(t *testing.T, p *pacer, wakeup time.Time, pts time.Duration) (time.Time, time.Duration) {
+	c.now = wakeup
+	late, ok := p.wait(context.Background(), pts)
+	if !ok {
+		t.Fatalf("frame at %s was not sent", pts)
+	}
+	if late == 0 {
+		// The pacer slept until the frame was due
+		c.now = p.start.Add(pts)
+	}
+	return c.now, late
+}
+
+// TestPacerJitter wakes up late and early around the due time of every frame
+// and checks frames are never sent early, and that their send times stay on the
+// sample timeline: lateness does not add up from one frame to the next.
+func TestPacerJitter(t *testing.T) {
+	p, clock := newTestPacer()
+	frame := time.Second / 30
+	origin := clock.now
+	// Wakeup offsets from the due time, early ones sleep for real so they are
+	// kept short
+	offsets := []time.Duration{0, 40 * time.Millisecond, -time.Millisecond, 120 * time.Millisecond, -2 * time.Millisecond, 10 * time.Millisecond, 450 * time.Millisecond}
+
+	for i := 0; i < 90; i++ {
+		pts := time.Duration(i) * frame
+		due := origin.Add(pts)
+		offset := offsets[i%len(offsets)]
+		sent, late := clock.send(t, p, due.Add(offset), pts)
+
+		if sent.Before(due) {
+			t.Fatalf("frame %d sent %s early", i, due.Sub(sent))
+		}
+		if behind := sent.Sub(due); behind > maxLateness {
+			t.Fatalf("frame %d sent %s behind the timeline", i, behind)
+		}
+		if offset > 0 && late != offset {
+			t.Errorf("frame %d is %s late, expected %s", i, late, offset)
+		}
+	}
+	if !p.start.Equal(origin) {
+		t.Errorf("pacer reset by %s without any stall", p.start.Sub(origin))
+	}
+}
+
+// TestPacerStall checks that a stall longer than maxLateness shifts the clock
+// so that the next frames are sent at their pace instead of in a burst, and
+// that a shorter one does not
+func TestPacerStall(t *testing.T) {
+	frame := time.Second / 30
+
+	for _, stall := range []time.Duration{300 * time.Millisecond, 2 * time.Second} {
+		p, clock := newTestPacer()
+		origin := clock.now
+		for i := 0; i < 10; i++ {
+			pts := time.Duration(i) * frame
+			clock.send(t, p, origin.Add(pts), pts)
+		}
+
+		// Frame 10 is sent after the stall, the next ones one frame apart
+		pts := 10 * frame
+		sent, late := clock.send(t, p, origin.Add(pts+stall), pts)
+		if late != stall {
+			t.Errorf("stall of %s: frame 10 is %s late, expected %s", stall, late, stall)
+		}
+		_, late = clock.send(t, p, sent.Add(frame), pts+frame)
+
+		reset := p.start.Sub(origin)
+		if stall > maxLateness {
+			if reset != stall {
+				t.Errorf("stall of %s: clock shifted by %s", stall, reset)
+			}
+			if late != 0 {
+				t.Errorf("stall of %s: frame 11 is %s late after the reset", stall, late)
+			}
+		} else {
+			if reset != 0 {
+				t.Errorf("stall of %s: clock shifted by %s, it should catch up", stall, reset)
+			}
+			if late != stall {
+				t.Errorf("stall of %s: frame 11 is %s late, expected %s", stall, late, stall)
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jtestard/tinygo-webrtc/testpattern"
+	"github.com/jtestard/tinygo-webrtc/vp8enc"
+)
+
+// patternSource yields the frames of the synthetic test pattern as VP8 key
+// frames, it never ends
+type patternSource struct {
+	pattern *testpattern.Generator
+	encoder *vp8enc.Encoder
+	// frameDuration is the time between two frames
+	frameDuration time.Duration
+	frame         int
+}
+
+func newPatternSource(width, height, fps int) *patternSource {
+	return &patternSource{
+		pattern:       testpattern.New(width, height),
+		encoder:       vp8enc.NewEncoder(vp8enc.DefaultQuantizer),
+		frameDuration: time.Second / time.Duration(fps),
+	}
+}
+
+func (s *patternSource) Codec() Codec {
+	return codecVP8
+}
+
+func (s *patternSource) NextSample() (Sample, error) {
+	data, err := s.encoder.Encode(s.pattern.Frame(s.frame))
+	if err != nil {
+		return Sample{}, err
+	}
+	sample := Sample{Data: data, PTS: time.Duration(s.frame) * s.frameDuration, Keyframe: true}
+	s.frame++
+	return sample, nil
+}
+
+func (s *patternSource) Close() error {
+	return nil
+}
+
+// newPatternPlaylist returns a playlist streaming the test pattern at fps
+// frames per second. size is the frame size as <width>x<height>.
+func newPatternPlaylist(size string, fps int) (*playlist, error) {
+	var width, height int
+	if _, err := fmt.Sscanf(size, "%dx%d", &width, &height); err != nil {
+		return nil, fmt.Errorf("invalid pattern size %q: %v", size, err)
+	}
+	if width <= 0 || height <= 0 || fps <= 0 {
+		return nil, fmt.Errorf("invalid pattern size %q at %d fps", size, fps)
+	}
+	open := func() (MediaSource, error) { return newPatternSource(width, height, fps), nil }
+	return &playlist{codec: codecVP8, sources: []func() (MediaSource, error){open}}, nil
+}
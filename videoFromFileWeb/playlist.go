@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jtestard/tinygo-webrtc/rtcsession"
+	"github.com/pion/webrtc/v3"
+)
+
+// playlist is a list of media sources of the same codec streamed one after
+// the other on the same track
+type playlist struct {
+	codec Codec
+	// sources opens every source of the playlist in turn
+	sources []func() (MediaSource, error)
+	loop    bool
+}
+
+// newFilePlaylist parses a comma separated list of media files, which must all
+// be encoded with the same codec
+func newFilePlaylist(files string, loop bool) (*playlist, error) {
+	p := &playlist{loop: loop}
+	var first string
+	for _, name := range strings.Split(files, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		codec, err := fileCodec(name)
+		if err != nil {
+			return nil, err
+		}
+		if first == "" {
+			first, p.codec = name, codec
+		} else if codec != p.codec {
+			return nil, fmt.Errorf("%s is %s while %s is %s", name, codec.Name, first, p.codec.Name)
+		}
+
+		name := name
+		p.sources = append(p.sources, func() (MediaSource, error) { return openFileSource(name) })
+	}
+	if first == "" {
+		return nil, errors.New("empty playlist")
+	}
+	return p, nil
+}
+
+// sourceWriter receives the samples of a stream once they are due, along with
+// the presentation timestamp of the sample after them
+type sourceWriter interface {
+	writeSample(kind webrtc.RTPCodecType, sample Sample, next time.Duration) error
+}
+
+// stream sends every source of the playlist to out until the playlist ends or
+// ctx is done. Sources are switched without a gap and presentation
+// timestamps keep increasing across sources. Samples are paced on clock.
+// Errors are logged and stop the stream, they never take the server down.
+// How late samples are sent is observed under the name of the broadcast.
+func (p *playlist) stream(ctx context.Context, broadcast string, out sourceWriter, clock *pacer) {
+	s := &sourceStreamer{ctx: ctx, broadcast: broadcast, kind: p.codec.Kind, out: out, pacer: clock}
+	for {
+		for i, open := range p.sources {
+			if err := s.streamSource(open); err == errStreamDone {
+				return
+			} else if err != nil {
+				log.Printf("could not stream %s source %d: %v\n", p.codec.Name, i, err)
+				return
+			}
+		}
+		if !p.loop || len(p.sources) == 0 {
+			break
+		}
+	}
+	if err := s.flush(); err != nil && err != errStreamDone {
+		log.Printf("could not send last sample: %v\n", err)
+	}
+}
+
+// errStreamDone is returned by the streamer when its context is done
+var errStreamDone = errors.New("stream done")
+
+// sourceStreamer sends samples at the pace given by their timestamps. The
+// duration of a sample, which sets the RTP timestamp of the next one, is only
+// known once the next sample is read, so one sample is always held back in
+// pending.
+type sourceStreamer struct {
+	ctx       context.Context
+	broadcast string
+	kind      webrtc.RTPCodecType
+	out       sourceWriter
+	pacer     *pacer
+
+	pending *Sample
+
+	// base is the presentation time at which the current source starts
+	base time.Duration
+	// duration is the duration of the last sample, used for the last sample
+	// of a source since there is no next timestamp to compare with
+	duration time.Duration
+}
+
+// streamSource sends the source returned by open and returns at its end, with
+// its last sample still pending
+func (s *sourceStreamer) streamSource(open func() (MediaSource, error)) error {
+	source, err := open()
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	pts := s.base
+	for {
+		sample, err := source.NextSample()
+		if err == io.EOF {
+			// The next source starts right after the last sample of this one
+			s.base = pts + s.duration
+			return nil
+		} else if err != nil {
+			return err
+		}
+		pts = s.base + sample.PTS
+		sample.PTS = pts
+
+		if err = s.push(sample); err != nil {
+			return err
+		}
+	}
+}
+
+// push queues sample and sends the previously pending one now that its
+// duration is known
+func (s *sourceStreamer) push(sample Sample) error {
+	if s.pending != nil {
+		if sample.PTS <= s.pending.PTS {
+			// Out of order or duplicated timestamp, keep the stream moving
+			sample.PTS = s.pending.PTS + s.duration
+		}
+		s.duration = sample.PTS - s.pending.PTS
+		if err := s.send(*s.pending, sample.PTS); err != nil {
+			return err
+		}
+	}
+	s.pending = &sample
+	return nil
+}
+
+// flush sends the pending sample at the end of the stream
+func (s *sourceStreamer) flush() error {
+	if s.pending == nil {
+		return nil
+	}
+	err := s.send(*s.pending, s.pending.PTS+s.duration)
+	s.pending = nil
+	return err
+}
+
+// send waits until sample is due and writes it, lasting until next
+func (s *sourceStreamer) send(sample Sample, next time.Duration) error {
+	late, ok := s.pacer.wait(s.ctx, sample.PTS)
+	if !ok {
+		return errStreamDone
+	}
+	rtcsession.ObserveLateness(s.broadcast, s.kind, late)
+	return s.out.writeSample(s.kind, sample, next)
+}
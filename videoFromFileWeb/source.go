@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+)
+
+// Codec describes the samples yielded by a MediaSource
+type Codec struct {
+	Kind      webrtc.RTPCodecType
+	Name      string
+	ClockRate uint32
+	Channels  uint16
+}
+
+var (
+	codecVP8  = Codec{Kind: webrtc.RTPCodecTypeVideo, Name: "VP8", ClockRate: videoClockRate}
+	codecH264 = Codec{Kind: webrtc.RTPCodecTypeVideo, Name: "H264", ClockRate: videoClockRate}
+	codecOpus = Codec{Kind: webrtc.RTPCodecTypeAudio, Name: "opus", ClockRate: opusClockRate, Channels: 2}
+)
+
+// MimeType returns the MIME type of the codec, as Pion names codecs
+func (c Codec) MimeType() string {
+	return c.Kind.String() + "/" + c.Name
+}
+
+// Sample is a video frame or a chunk of audio
+type Sample struct {
+	Data []byte
+	// PTS is the presentation timestamp of the sample from the start of its
+	// source
+	PTS time.Duration
+	// Keyframe is set when the sample can be decoded on its own
+	Keyframe bool
+}
+
+// MediaSource yields the timestamped samples of a single media stream.
+// NextSample returns io.EOF once the stream ended.
+type MediaSource interface {
+	Codec() Codec
+	NextSample() (Sample, error)
+	Close() error
+}
+
+// fileCodecs maps the extensions of the media files we read to their codec
+var fileCodecs = map[string]Codec{
+	".ivf":  codecVP8,
+	".h264": codecH264,
+	".264":  codecH264,
+	".ogg":  codecOpus,
+	".opus": codecOpus,
+}
+
+// fileCodec returns the codec of the media file name from its extension
+func fileCodec(name string) (Codec, error) {
+	codec, ok := fileCodecs[strings.ToLower(filepath.Ext(name))]
+	if !ok {
+		return Codec{}, fmt.Errorf("%s: unknown media file type", name)
+	}
+	return codec, nil
+}
+
+// openFileSource opens the media file name with the source matching its
+// extension
+func openFileSource(name string) (MediaSource, error) {
+	codec, err := fileCodec(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var source MediaSource
+	switch codec {
+	case codecVP8:
+		source, err = newIVFSource(file)
+	case codecH264:
+		source = newH264Source(file)
+	case codecOpus:
+		source, err = newOggSource(file)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return source, nil
+}
+
+// ivfSource reads the VP8 frames of an IVF file
+type ivfSource struct {
+	file     io.ReadCloser
+	ivf      *ivfreader.IVFReader
+	timebase time.Duration
+
+	started bool
+	first   uint64
+}
+
+func newIVFSource(file io.ReadCloser) (*ivfSource, error) {
+	ivf, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		return nil, err
+	}
+	// IVF timestamps count in units of the timebase
+	timebase := time.Duration(header.TimebaseNumerator) * time.Second / time.Duration(header.TimebaseDenominator)
+	return &ivfSource{file: file, ivf: ivf, timebase: timebase}, nil
+}
+
+func (s *ivfSource) Codec() Codec {
+	return codecVP8
+}
+
+func (s *ivfSource) NextSample() (Sample, error) {
+	frame, header, err := s.ivf.ParseNextFrame()
+	if err != nil {
+		return Sample{}, err
+	}
+	if !s.started {
+		s.started, s.first = true, header.Timestamp
+	}
+	return Sample{
+		Data:     frame,
+		PTS:      time.Duration(header.Timestamp-s.first) * s.timebase,
+		Keyframe: isVP8Keyframe(frame),
+	}, nil
+}
+
+func (s *ivfSource) Close() error {
+	return s.file.Close()
+}
+
+// h264Source reads the access units of an H.264 Annex-B file
+type h264Source struct {
+	file io.ReadCloser
+	h264 *h264Reader
+}
+
+func newH264Source(file io.ReadCloser) *h264Source {
+	return &h264Source{file: file, h264: newH264Reader(file)}
+}
+
+func (s *h264Source) Codec() Codec {
+	return codecH264
+}
+
+func (s *h264Source) NextSample() (Sample, error) {
+	au, frame, err := s.h264.nextFrame()
+	if err != nil {
+		return Sample{}, err
+	}
+	return Sample{
+		Data:     au,
+		PTS:      time.Duration(frame) * s.h264.timebase(),
+		Keyframe: isH264Keyframe(au),
+	}, nil
+}
+
+func (s *h264Source) Close() error {
+	return s.file.Close()
+}
+
+// oggSource reads the Opus packets of an Ogg file, each one is a sample
+type oggSource struct {
+	file io.ReadCloser
+	ogg  *oggReader
+	// preSkip is the number of samples still to drop from the start of the
+	// stream, the encoder priming the decoder
+	preSkip int
+	// samples is the number of samples read so far, where the next packet
+	// starts
+	samples int
+}
+
+func newOggSource(file io.ReadCloser) (*oggSource, error) {
+	ogg := newOggReader(file)
+	head, err := ogg.nextPacket()
+	if err != nil {
+		return nil, err
+	}
+	preSkip, err := parseOpusHead(head)
+	if err != nil {
+		return nil, err
+	}
+	// The comment header carries no audio
+	if _, err = ogg.nextPacket(); err != nil {
+		return nil, err
+	}
+	return &oggSource{file: file, ogg: ogg, preSkip: preSkip}, nil
+}
+
+func (s *oggSource) Codec() Codec {
+	return codecOpus
+}
+
+func (s *oggSource) NextSample() (Sample, error) {
+	for {
+		packet, err := s.ogg.nextPacket()
+		if err != nil {
+			return Sample{}, err
+		}
+		// Empty packets mark lost or discontinued audio, there is nothing to send
+		if len(packet) == 0 {
+			continue
+		}
+		samples, err := opusPacketSamples(packet)
+		if err != nil {
+			return Sample{}, err
+		}
+		// Drop the packets that are entirely pre-skip
+		if samples <= s.preSkip {
+			s.preSkip -= samples
+			continue
+		}
+		s.preSkip = 0
+
+		pts := time.Duration(s.samples) * time.Second / opusClockRate
+		s.samples += samples
+		return Sample{Data: packet, PTS: pts, Keyframe: true}, nil
+	}
+}
+
+func (s *oggSource) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jtestard/tinygo-webrtc/rtcconfig"
+	"github.com/jtestard/tinygo-webrtc/webrtcclient"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// startPatternServer serves a broadcast of the test pattern at 30 fps
+func startPatternServer(t *testing.T) *httptest.Server {
+	rtcConfig = rtcconfig.Default()
+	rtcConfig.HostOnly = true
+	p, err := newPatternPlaylist("64x64", 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broadcasts = []*broadcaster{newBroadcaster("pattern", p, nil)}
+	return httptest.NewServer(newHandler())
+}
+
+// TestStreamPattern receives the test pattern and checks that its frames are
+// timestamped 1/30 s apart
+func TestStreamPattern(t *testing.T) {
+	server := startPatternServer(t)
+	defer server.Close()
+
+	c, err := webrtcclient.Dial(server.URL, webrtcclient.Options{Source: "pattern"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var frames []uint32
+	deadline := time.After(10 * time.Second)
+	for len(frames) < 10 {
+		select {
+		case packet := <-c.Packets():
+			if packet.Kind != webrtc.RTPCodecTypeVideo || !strings.EqualFold(packet.MimeType, webrtc.MimeTypeVP8) {
+				t.Fatalf("received %s %s, expected VP8 video", packet.MimeType, packet.Kind)
+			}
+			vp8 := codecs.VP8Packet{}
+			if _, err = vp8.Unmarshal(packet.RTP.Payload); err != nil {
+				t.Fatal(err)
+			}
+			if vp8.S == 1 {
+				frames = append(frames, packet.RTP.Timestamp)
+			}
+		case <-deadline:
+			t.Fatalf("received %d frames only", len(frames))
+		}
+	}
+	for i := 1; i < len(frames); i++ {
+		if delta := frames[i] - frames[i-1]; delta != videoClockRate/30 {
+			t.Errorf("frame %d is %d ticks after the previous one, expected %d", i, delta, videoClockRate/30)
+		}
+	}
+}
+
+// TestStreamUnknownSource checks that picking a source the server lacks fails
+func TestStreamUnknownSource(t *testing.T) {
+	server := startPatternServer(t)
+	defer server.Close()
+
+	_, err := webrtcclient.Dial(server.URL, webrtcclient.Options{Source: "nope"})
+	if err == nil || !strings.Contains(err.Error(), "source_not_found") {
+		t.Errorf("expected a source_not_found error, got %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jtestard/tinygo-webrtc/rtcsession"
+	"github.com/pion/webrtc/v3"
+)
+
+// whepPath is the WHEP endpoint. Sessions are exposed as resources below it.
+const whepPath = "/whep"
+
+// whepHandler implements WebRTC-HTTP egress (WHEP). A POST of an
+// application/sdp offer on /whep starts streaming the file and answers with
+// 201 Created, the SDP answer and a Location header pointing at the session
+// resource. A DELETE on that resource tears the session down.
+func whepHandler(w http.ResponseWriter, r *http.Request) {
+	setWHEPHeaders(w)
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, whepPath), "/")
+	switch {
+	case r.Method == http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && id == "":
+		whepOpen(w, r)
+	case r.Method == http.MethodDelete && id != "":
+		whepClose(w, r, id)
+	default:
+		rtcsession.WriteError(w, rtcsession.ErrMethodNotAllowed(r.Method))
+	}
+}
+
+func whepOpen(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	var err error
+	defer func() { rtcsession.ObserveOpen("whep", start, err) }()
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != "application/sdp" {
+		err = rtcsession.ErrUnsupportedContentType(r.Header.Get("Content-Type"))
+		rtcsession.WriteError(w, err)
+		return
+	}
+
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err = rtcsession.ErrBadOffer(err)
+		rtcsession.WriteError(w, err)
+		return
+	}
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(buf)}
+
+	// WHEP does not trickle candidates, the answer lists every one
+	s, answer, err := openSession(offer, r.URL.Query().Get("source"), nil)
+	if err != nil {
+		rtcsession.WriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", whepPath+"/"+s.ID)
+	w.WriteHeader(http.StatusCreated)
+	if _, writeErr := w.Write([]byte(answer.SDP)); writeErr != nil {
+		fmt.Printf("session %s: could not send WHEP answer: %v\n", s.ID, writeErr)
+		return
+	}
+	fmt.Printf("session %s: WHEP answer sent\n", s.ID)
+}
+
+func whepClose(w http.ResponseWriter, r *http.Request, id string) {
+	s := sessions.Remove(id)
+	if s == nil {
+		rtcsession.WriteError(w, rtcsession.ErrResourceNotFound(r.URL.Path))
+		return
+	}
+	if err := s.Close(); err != nil {
+		rtcsession.WriteError(w, rtcsession.ErrInternal(err))
+		return
+	}
+	fmt.Printf("session %s closed\n", id)
+	w.WriteHeader(http.StatusOK)
+}
+
+// setWHEPHeaders allows browser based WHEP players served from another origin
+// to reach the endpoint and read the session Location
+func setWHEPHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+}
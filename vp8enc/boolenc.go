@@ -0,0 +1,76 @@
+package vp8enc
+
+// boolEncoder is the boolean entropy encoder specified in section 7.3 of
+// RFC 6386. Every bool is written with the probability, out of 256, that it is
+// false.
+type boolEncoder struct {
+	out      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newBoolEncoder() *boolEncoder {
+	return &boolEncoder{rng: 255, bitCount: 24}
+}
+
+// writeBool writes b, which is false with probability prob/256
+func (e *boolEncoder) writeBool(prob uint8, b bool) {
+	split := 1 + ((e.rng-1)*uint32(prob))>>8
+	if b {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			e.carry()
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.out = append(e.out, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// writeLiteral writes the n low bits of v, most significant first, with even
+// probabilities
+func (e *boolEncoder) writeLiteral(v uint32, n int) {
+	for n--; n >= 0; n-- {
+		e.writeBool(128, v>>uint(n)&1 != 0)
+	}
+}
+
+// carry propagates a carry into the bytes already written
+func (e *boolEncoder) carry() {
+	i := len(e.out) - 1
+	for ; i >= 0 && e.out[i] == 0xff; i-- {
+		e.out[i] = 0
+	}
+	if i >= 0 {
+		e.out[i]++
+	}
+}
+
+// flush writes the bits still held in bottom and returns the encoded bytes
+func (e *boolEncoder) flush() []byte {
+	c := e.bitCount
+	v := e.bottom
+	if v&(1<<uint(32-c)) != 0 {
+		e.carry()
+	}
+	v <<= uint(c & 7)
+	for c >>= 3; c > 0; c-- {
+		v <<= 8
+	}
+	for c = 0; c < 4; c++ {
+		e.out = append(e.out, byte(v>>24))
+		v <<= 8
+	}
+	return e.out
+}
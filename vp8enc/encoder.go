@@ -0,0 +1,506 @@
+// Package vp8enc encodes images as VP8 key frames in pure Go. It trades
+// compression for simplicity: every frame is a key frame, every macroblock is
+// DC predicted and the loop filter is off. That is plenty for test patterns and
+// for the streams of emulated games, which browsers decode like any other VP8
+// stream.
+package vp8enc
+
+import (
+	"errors"
+	"image"
+	"image/color"
+)
+
+// DefaultQuantizer is a quantizer index giving good quality at a reasonable
+// size for small frames
+const DefaultQuantizer = 24
+
+// maxDimension is the largest width or height a VP8 frame header can carry
+const maxDimension = 1<<14 - 1
+
+// Encoder encodes images as VP8 key frames
+type Encoder struct {
+	// Quantizer is the quantizer index, from 0 for the best quality to 127
+	// for the smallest frames
+	Quantizer int
+}
+
+// NewEncoder returns an encoder using the quantizer index quantizer
+func NewEncoder(quantizer int) *Encoder {
+	return &Encoder{Quantizer: quantizer}
+}
+
+// quantizer holds the DC and AC step sizes of each kind of block
+type quantizer struct {
+	y1, y2, uv [2]int32
+}
+
+func newQuantizer(q int) quantizer {
+	z := quantizer{
+		y1: [2]int32{int32(dcTable[q]), int32(acTable[q])},
+		y2: [2]int32{int32(dcTable[q]) * 2, int32(acTable[q]) * 155 / 100},
+		uv: [2]int32{int32(dcTable[q]), int32(acTable[q])},
+	}
+	if z.y2[1] < 8 {
+		z.y2[1] = 8
+	}
+	if z.uv[0] > 132 {
+		z.uv[0] = 132
+	}
+	return z
+}
+
+// Encode returns img as a VP8 key frame. Images other than 4:2:0 YCbCr are
+// converted first.
+func (e *Encoder) Encode(img image.Image) ([]byte, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return nil, errors.New("vp8enc: empty image")
+	}
+	if b.Dx() > maxDimension || b.Dy() > maxDimension {
+		return nil, errors.New("vp8enc: image too large")
+	}
+
+	q := e.Quantizer
+	if q < 0 || q > 127 {
+		return nil, errors.New("vp8enc: quantizer out of range")
+	}
+	f := newFrame(img, newQuantizer(q))
+
+	header := newBoolEncoder()
+	writeFrameHeader(header, q)
+	tokens := newBoolEncoder()
+	for mby := 0; mby < f.mbh; mby++ {
+		f.leftY2, f.leftY, f.leftU, f.leftV = 0, [4]uint8{}, [2]uint8{}, [2]uint8{}
+		for mbx := 0; mbx < f.mbw; mbx++ {
+			f.encodeMacroblock(header, tokens, mbx, mby)
+		}
+	}
+	first := header.flush()
+	residuals := tokens.flush()
+
+	// The frame tag holds the key frame flag, the version, the show frame flag
+	// and the size of the first partition, followed by the start code and the
+	// dimensions of key frames
+	out := make([]byte, 0, 10+len(first)+len(residuals))
+	tag := uint32(len(first))<<5 | 1<<4
+	out = append(out, byte(tag), byte(tag>>8), byte(tag>>16))
+	out = append(out, 0x9d, 0x01, 0x2a)
+	out = append(out, byte(b.Dx()), byte(b.Dx()>>8), byte(b.Dy()), byte(b.Dy()>>8))
+	out = append(out, first...)
+	return append(out, residuals...), nil
+}
+
+// writeFrameHeader writes the key frame header of section 9 to the first
+// partition
+func writeFrameHeader(e *boolEncoder, q int) {
+	// Color space and clamping type
+	e.writeLiteral(0, 1)
+	e.writeLiteral(0, 1)
+	// No segmentation
+	e.writeLiteral(0, 1)
+	// Simple filter type, loop filter off, sharpness and no filter deltas
+	e.writeLiteral(0, 1)
+	e.writeLiteral(0, 6)
+	e.writeLiteral(0, 3)
+	e.writeLiteral(0, 1)
+	// A single token partition
+	e.writeLiteral(0, 2)
+	// The quantizer index, with no delta for any kind of block
+	e.writeLiteral(uint32(q), 7)
+	for i := 0; i < 5; i++ {
+		e.writeLiteral(0, 1)
+	}
+	// Refresh entropy probabilities
+	e.writeLiteral(1, 1)
+	// Keep the default token probabilities
+	for i := range tokenProbUpdateProb {
+		for j := range tokenProbUpdateProb[i] {
+			for k := range tokenProbUpdateProb[i][j] {
+				for _, p := range tokenProbUpdateProb[i][j][k] {
+					e.writeBool(p, false)
+				}
+			}
+		}
+	}
+	// Every macroblock codes its coefficients
+	e.writeLiteral(0, 1)
+}
+
+// frame holds the source planes of the image being encoded, padded to whole
+// macroblocks, and the planes the decoder reconstructs which macroblocks are
+// predicted from
+type frame struct {
+	mbw, mbh int
+	q        quantizer
+
+	srcY, srcU, srcV []uint8
+	recY, recU, recV []uint8
+	// yStride is the stride of the luma planes, the chroma planes have half
+	// of it
+	yStride int
+
+	// Whether the blocks left of and above the current macroblock have non
+	// zero coefficients, which sets the context of its tokens
+	leftY2         uint8
+	leftY          [4]uint8
+	leftU, leftV   [2]uint8
+	aboveY2        []uint8
+	aboveY         [][4]uint8
+	aboveU, aboveV [][2]uint8
+}
+
+func newFrame(img image.Image, q quantizer) *frame {
+	b := img.Bounds()
+	mbw, mbh := (b.Dx()+15)/16, (b.Dy()+15)/16
+	f := &frame{
+		mbw:     mbw,
+		mbh:     mbh,
+		q:       q,
+		yStride: mbw * 16,
+		srcY:    make([]uint8, mbw*mbh*256),
+		srcU:    make([]uint8, mbw*mbh*64),
+		srcV:    make([]uint8, mbw*mbh*64),
+		recY:    make([]uint8, mbw*mbh*256),
+		recU:    make([]uint8, mbw*mbh*64),
+		recV:    make([]uint8, mbw*mbh*64),
+		aboveY2: make([]uint8, mbw),
+		aboveY:  make([][4]uint8, mbw),
+		aboveU:  make([][2]uint8, mbw),
+		aboveV:  make([][2]uint8, mbw),
+	}
+	f.load(img)
+	return f
+}
+
+// load copies img to the source planes, repeating its last row and column
+// over the padding
+func (f *frame) load(img image.Image) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	cStride := f.yStride / 2
+	if ycc, ok := img.(*image.YCbCr); ok && ycc.SubsampleRatio == image.YCbCrSubsampleRatio420 {
+		for y := 0; y < f.mbh*16; y++ {
+			sy := b.Min.Y + clampIndex(y, h)
+			for x := 0; x < f.yStride; x++ {
+				sx := b.Min.X + clampIndex(x, w)
+				f.srcY[y*f.yStride+x] = ycc.Y[ycc.YOffset(sx, sy)]
+				if x%2 == 0 && y%2 == 0 {
+					c := ycc.COffset(sx, sy)
+					f.srcU[y/2*cStride+x/2] = ycc.Cb[c]
+					f.srcV[y/2*cStride+x/2] = ycc.Cr[c]
+				}
+			}
+		}
+		return
+	}
+
+	// Other images are converted pixel by pixel, chroma being averaged over
+	// each 2x2 square
+	for y := 0; y < f.mbh*16; y += 2 {
+		for x := 0; x < f.yStride; x += 2 {
+			var cb, cr int
+			for _, d := range [4]image.Point{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				sx := b.Min.X + clampIndex(x+d.X, w)
+				sy := b.Min.Y + clampIndex(y+d.Y, h)
+				r, g, bl, _ := img.At(sx, sy).RGBA()
+				yy, u, v := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+				f.srcY[(y+d.Y)*f.yStride+x+d.X] = yy
+				cb += int(u)
+				cr += int(v)
+			}
+			f.srcU[y/2*cStride+x/2] = uint8((cb + 2) / 4)
+			f.srcV[y/2*cStride+x/2] = uint8((cr + 2) / 4)
+		}
+	}
+}
+
+// clampIndex returns i, or the last index when i is past n
+func clampIndex(i, n int) int {
+	if i >= n {
+		return n - 1
+	}
+	return i
+}
+
+// encodeMacroblock writes the modes of a macroblock to header and its
+// coefficients to tokens, then reconstructs it the way the decoder will
+func (f *frame) encodeMacroblock(header, tokens *boolEncoder, mbx, mby int) {
+	// DC_PRED for luma, coded with the key frame ymode tree and its fixed
+	// probabilities, then DC_PRED for chroma
+	header.writeBool(145, true)
+	header.writeBool(156, false)
+	header.writeBool(163, false)
+	header.writeBool(142, false)
+
+	// Luma: the DCs of the 16 blocks go through the second order transform,
+	// the blocks then only code their AC coefficients
+	yOff := mby*16*f.yStride + mbx*16
+	yPred := dcPredict(f.recY, yOff, f.yStride, 16, mbx > 0, mby > 0)
+	var blocks [16][16]int32
+	var dcs [16]int32
+	for i := range blocks {
+		off := yOff + i/4*4*f.yStride + i%4*4
+		var residual [16]int32
+		for j := range residual {
+			residual[j] = int32(f.srcY[off+j/4*f.yStride+j%4]) - int32(yPred)
+		}
+		fdct(&residual, &blocks[i])
+		dcs[i] = blocks[i][0]
+	}
+	var y2 [16]int32
+	fwht(&dcs, &y2)
+	quantize(&y2, f.q.y2, 0)
+	nz := writeCoefficients(tokens, planeY2, f.leftY2+f.aboveY2[mbx], &y2, 0)
+	f.leftY2, f.aboveY2[mbx] = nz, nz
+
+	for i := range blocks {
+		quantize(&blocks[i], f.q.y1, 1)
+		x, y := i%4, i/4
+		nz := writeCoefficients(tokens, planeY1WithY2, f.leftY[y]+f.aboveY[mbx][x], &blocks[i], 1)
+		f.leftY[y], f.aboveY[mbx][x] = nz, nz
+	}
+
+	// Chroma blocks code all their coefficients
+	cStride := f.yStride / 2
+	cOff := mby*8*cStride + mbx*8
+	uPred := dcPredict(f.recU, cOff, cStride, 8, mbx > 0, mby > 0)
+	vPred := dcPredict(f.recV, cOff, cStride, 8, mbx > 0, mby > 0)
+	var uBlocks, vBlocks [4][16]int32
+	for i := 0; i < 4; i++ {
+		off := cOff + i/2*4*cStride + i%2*4
+		var u, v [16]int32
+		for j := range u {
+			u[j] = int32(f.srcU[off+j/4*cStride+j%4]) - int32(uPred)
+			v[j] = int32(f.srcV[off+j/4*cStride+j%4]) - int32(vPred)
+		}
+		fdct(&u, &uBlocks[i])
+		fdct(&v, &vBlocks[i])
+		quantize(&uBlocks[i], f.q.uv, 0)
+		quantize(&vBlocks[i], f.q.uv, 0)
+	}
+	for i := range uBlocks {
+		x, y := i%2, i/2
+		nz := writeCoefficients(tokens, planeUV, f.leftU[y]+f.aboveU[mbx][x], &uBlocks[i], 0)
+		f.leftU[y], f.aboveU[mbx][x] = nz, nz
+	}
+	for i := range vBlocks {
+		x, y := i%2, i/2
+		nz := writeCoefficients(tokens, planeUV, f.leftV[y]+f.aboveV[mbx][x], &vBlocks[i], 0)
+		f.leftV[y], f.aboveV[mbx][x] = nz, nz
+	}
+
+	// Reconstruct the macroblock from the quantized coefficients
+	dequantize(&y2, f.q.y2)
+	yDCs := iwht(&y2)
+	fill(f.recY[yOff:], f.yStride, 16, yPred)
+	for i := range blocks {
+		dequantize(&blocks[i], f.q.y1)
+		blocks[i][0] = yDCs[i]
+		idct(&blocks[i], f.recY[yOff+i/4*4*f.yStride+i%4*4:], f.yStride)
+	}
+	fill(f.recU[cOff:], cStride, 8, uPred)
+	fill(f.recV[cOff:], cStride, 8, vPred)
+	for i := 0; i < 4; i++ {
+		off := cOff + i/2*4*cStride + i%2*4
+		dequantize(&uBlocks[i], f.q.uv)
+		dequantize(&vBlocks[i], f.q.uv)
+		idct(&uBlocks[i], f.recU[off:], cStride)
+		idct(&vBlocks[i], f.recV[off:], cStride)
+	}
+}
+
+// dcPredict returns the DC prediction of the size x size block at off in pix
+// from the reconstructed pixels left of and above it, as specified in
+// section 12.2
+func dcPredict(pix []uint8, off, stride, size int, hasLeft, hasAbove bool) uint8 {
+	shift := 3
+	if size == 16 {
+		shift = 4
+	}
+	sum := 0
+	if hasAbove {
+		for i := 0; i < size; i++ {
+			sum += int(pix[off-stride+i])
+		}
+	}
+	if hasLeft {
+		for j := 0; j < size; j++ {
+			sum += int(pix[off+j*stride-1])
+		}
+	}
+	switch {
+	case hasAbove && hasLeft:
+		shift++
+	case !hasAbove && !hasLeft:
+		return 128
+	}
+	return uint8((sum + 1<<uint(shift-1)) >> uint(shift))
+}
+
+func fill(pix []uint8, stride, size int, v uint8) {
+	for j := 0; j < size; j++ {
+		for i := 0; i < size; i++ {
+			pix[j*stride+i] = v
+		}
+	}
+}
+
+// maxCoefficient is the largest magnitude a DCT token can code
+const maxCoefficient = 2048 + 66
+
+// quantize divides the coefficients of a block from first on by their step
+// size, rounding to the nearest
+func quantize(coeffs *[16]int32, steps [2]int32, first int) {
+	if first > 0 {
+		coeffs[0] = 0
+	}
+	for i := first; i < 16; i++ {
+		step := steps[1]
+		if i == 0 {
+			step = steps[0]
+		}
+		v := coeffs[i]
+		neg := v < 0
+		if neg {
+			v = -v
+		}
+		v = (v + step/2) / step
+		if v > maxCoefficient {
+			v = maxCoefficient
+		}
+		if neg {
+			v = -v
+		}
+		coeffs[i] = v
+	}
+}
+
+func dequantize(coeffs *[16]int32, steps [2]int32) {
+	coeffs[0] *= steps[0]
+	for i := 1; i < 16; i++ {
+		coeffs[i] *= steps[1]
+	}
+}
+
+var (
+	// bands maps the position of a coefficient in zigzag order to its band,
+	// as specified in section 13.3
+	bands = [17]uint8{0, 1, 2, 3, 6, 4, 5, 6, 6, 6, 6, 6, 6, 6, 6, 7, 0}
+	// zigzag is the order coefficients are coded in
+	zigzag = [16]uint8{0, 1, 4, 8, 5, 2, 3, 6, 9, 12, 13, 10, 7, 11, 14, 15}
+	// catProbs are the probabilities of the extra bits of the DCT_CAT3 to
+	// DCT_CAT6 tokens, specified in section 13.2
+	catProbs = [4][]uint8{
+		{173, 148, 140},
+		{176, 155, 140, 135},
+		{180, 157, 141, 134, 130},
+		{254, 254, 243, 230, 196, 177, 153, 140, 133, 130, 129},
+	}
+)
+
+// writeCoefficients writes the tokens of the quantized coefficients of a
+// block, from first on, as specified in section 13. ctx is the number of
+// blocks left of and above it with non zero coefficients. It returns 1 when
+// the block has non zero coefficients.
+func writeCoefficients(e *boolEncoder, plane int, ctx uint8, coeffs *[16]int32, first int) uint8 {
+	last := -1
+	for n := first; n < 16; n++ {
+		if coeffs[zigzag[n]] != 0 {
+			last = n
+		}
+	}
+
+	probs := &defaultTokenProb[plane]
+	p := &probs[bands[first]][ctx]
+	if last < 0 {
+		// DCT_EOB
+		e.writeBool(p[0], false)
+		return 0
+	}
+
+	// There is no end of block after a zero, the block would have ended
+	// before it
+	afterZero := false
+	for n := first; n <= last; n++ {
+		if !afterZero {
+			e.writeBool(p[0], true)
+		}
+		v := coeffs[zigzag[n]]
+		if v == 0 {
+			e.writeBool(p[1], false)
+			p = &probs[bands[n+1]][0]
+			afterZero = true
+			continue
+		}
+		afterZero = false
+		e.writeBool(p[1], true)
+
+		abs := v
+		if abs < 0 {
+			abs = -abs
+		}
+		if abs == 1 {
+			e.writeBool(p[2], false)
+			e.writeBool(128, v < 0)
+			p = &probs[bands[n+1]][1]
+			continue
+		}
+		e.writeBool(p[2], true)
+		writeLargeToken(e, p, abs)
+		e.writeBool(128, v < 0)
+		p = &probs[bands[n+1]][2]
+	}
+	if last < 15 {
+		e.writeBool(p[0], false)
+	}
+	return 1
+}
+
+// writeLargeToken writes the token of a coefficient of magnitude v > 1 along
+// with its extra bits
+func writeLargeToken(e *boolEncoder, p *[nProb]uint8, v int32) {
+	switch {
+	case v <= 4:
+		e.writeBool(p[3], false)
+		if v == 2 {
+			e.writeBool(p[4], false)
+			return
+		}
+		e.writeBool(p[4], true)
+		e.writeBool(p[5], v == 4)
+	case v <= 6:
+		// DCT_CAT1
+		e.writeBool(p[3], true)
+		e.writeBool(p[6], false)
+		e.writeBool(p[7], false)
+		e.writeBool(159, v == 6)
+	case v <= 10:
+		// DCT_CAT2
+		e.writeBool(p[3], true)
+		e.writeBool(p[6], false)
+		e.writeBool(p[7], true)
+		e.writeBool(165, (v-7)&2 != 0)
+		e.writeBool(145, (v-7)&1 != 0)
+	default:
+		// DCT_CAT3 to DCT_CAT6 start at 11, 19, 35 and 67
+		cat := 0
+		for cat < 3 && v >= 3+(8<<uint(cat+1)) {
+			cat++
+		}
+		e.writeBool(p[3], true)
+		e.writeBool(p[6], true)
+		b1 := cat >= 2
+		e.writeBool(p[8], b1)
+		if b1 {
+			e.writeBool(p[10], cat == 3)
+		} else {
+			e.writeBool(p[9], cat == 1)
+		}
+		extra := v - 3 - (8 << uint(cat))
+		probs := catProbs[cat]
+		for i, prob := range probs {
+			e.writeBool(prob, extra>>uint(len(probs)-1-i)&1 != 0)
+		}
+	}
+}
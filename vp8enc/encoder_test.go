@@ -0,0 +1,98 @@
+package vp8enc
+
+import (
+	"bytes"
+	"image"
+	"math"
+	"testing"
+
+	"github.com/jtestard/tinygo-webrtc/testpattern"
+	"golang.org/x/image/vp8"
+)
+
+// TestEncodeDecode encodes the test pattern at a few quantizers, decodes the
+// frames with the x/image decoder and checks their size and quality. The PSNR
+// falls and the frames shrink as the quantizer grows.
+func TestEncodeDecode(t *testing.T) {
+	// 100x60 is not a multiple of the macroblock size
+	src := testpattern.New(100, 60).Frame(7)
+	tests := []struct {
+		quantizer int
+		minPSNR   float64
+	}{
+		{0, 55},
+		{DefaultQuantizer, 44},
+		{64, 35},
+		{127, 26},
+	}
+
+	lastSize := math.MaxInt32
+	for _, test := range tests {
+		frame, err := NewEncoder(test.quantizer).Encode(src)
+		if err != nil {
+			t.Fatalf("quantizer %d: %v", test.quantizer, err)
+		}
+		decoded := decode(t, frame)
+		if decoded.Bounds() != src.Bounds() {
+			t.Fatalf("quantizer %d: decoded a %v frame, expected %v", test.quantizer, decoded.Bounds(), src.Bounds())
+		}
+		if psnr := lumaPSNR(src, decoded); psnr < test.minPSNR {
+			t.Errorf("quantizer %d: PSNR is %.1f dB, expected at least %.0f", test.quantizer, psnr, test.minPSNR)
+		}
+		if len(frame) >= lastSize {
+			t.Errorf("quantizer %d: frame is %d bytes, no smaller than %d at the previous quantizer", test.quantizer, len(frame), lastSize)
+		}
+		lastSize = len(frame)
+	}
+}
+
+// TestEncodeRGBA checks that images other than YCbCr are converted
+func TestEncodeRGBA(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for i := 0; i < len(src.Pix); i += 4 {
+		src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3] = 200, 40, 40, 255
+	}
+	frame, err := NewEncoder(DefaultQuantizer).Encode(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, g, b, _ := decode(t, frame).At(16, 16).RGBA()
+	if r>>8 < 180 || g>>8 > 70 || b>>8 > 70 {
+		t.Errorf("decoded (%d, %d, %d), expected about (200, 40, 40)", r>>8, g>>8, b>>8)
+	}
+}
+
+func decode(t *testing.T, frame []byte) *image.YCbCr {
+	d := vp8.NewDecoder()
+	d.Init(bytes.NewReader(frame), len(frame))
+	header, err := d.DecodeFrameHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.KeyFrame {
+		t.Fatal("not a key frame")
+	}
+	img, err := d.DecodeFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// lumaPSNR returns the peak signal to noise ratio of the Y plane of b against
+// the one of a, in dB
+func lumaPSNR(a, b *image.YCbCr) float64 {
+	r := a.Bounds()
+	var sum float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			d := float64(a.Y[a.YOffset(x, y)]) - float64(b.Y[b.YOffset(x, y)])
+			sum += d * d
+		}
+	}
+	mse := sum / float64(r.Dx()*r.Dy())
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/mse)
+}
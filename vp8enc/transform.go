@@ -0,0 +1,135 @@
+package vp8enc
+
+// The forward transforms follow the reference encoder, they only need to
+// approximate the inverse of the decoder transforms. The inverse transforms
+// are specified in sections 14.3 and 14.4 and must match the decoder exactly
+// since the encoder predicts from the frame the decoder reconstructs.
+
+// fdct computes the DCT of a 4x4 block of residuals, in and out are in raster
+// order
+func fdct(in, out *[16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 16; i += 4 {
+		a := (in[i+0] + in[i+3]) * 8
+		b := (in[i+1] + in[i+2]) * 8
+		c := (in[i+1] - in[i+2]) * 8
+		d := (in[i+0] - in[i+3]) * 8
+		tmp[i+0] = a + b
+		tmp[i+2] = a - b
+		tmp[i+1] = (c*2217 + d*5352 + 14500) >> 12
+		tmp[i+3] = (d*2217 - c*5352 + 7500) >> 12
+	}
+	for i := 0; i < 4; i++ {
+		a := tmp[i+0] + tmp[i+12]
+		b := tmp[i+4] + tmp[i+8]
+		c := tmp[i+4] - tmp[i+8]
+		d := tmp[i+0] - tmp[i+12]
+		out[i+0] = (a + b + 7) >> 4
+		out[i+8] = (a - b + 7) >> 4
+		out[i+4] = (c*2217 + d*5352 + 12000) >> 16
+		if d != 0 {
+			out[i+4]++
+		}
+		out[i+12] = (d*2217 - c*5352 + 51000) >> 16
+	}
+}
+
+// fwht computes the Walsh-Hadamard transform of the DC coefficients of the 16
+// luma blocks of a macroblock
+func fwht(in, out *[16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 16; i += 4 {
+		a := (in[i+0] + in[i+2]) * 4
+		d := (in[i+1] + in[i+3]) * 4
+		c := (in[i+1] - in[i+3]) * 4
+		b := (in[i+0] - in[i+2]) * 4
+		tmp[i+0] = a + d
+		if a != 0 {
+			tmp[i+0]++
+		}
+		tmp[i+1] = b + c
+		tmp[i+2] = b - c
+		tmp[i+3] = a - d
+	}
+	for i := 0; i < 4; i++ {
+		a := tmp[i+0] + tmp[i+8]
+		d := tmp[i+4] + tmp[i+12]
+		c := tmp[i+4] - tmp[i+12]
+		b := tmp[i+0] - tmp[i+8]
+		for j, v := range [4]int32{a + d, b + c, b - c, a - d} {
+			if v < 0 {
+				v++
+			}
+			out[i+4*j] = (v + 3) >> 3
+		}
+	}
+}
+
+// idct adds the inverse DCT of coeffs to the 4x4 block at the start of pix
+func idct(coeffs *[16]int32, pix []uint8, stride int) {
+	const (
+		c1 = 85627 // 65536 * cos(pi/8) * sqrt(2)
+		c2 = 35468 // 65536 * sin(pi/8) * sqrt(2)
+	)
+	var m [4][4]int32
+	for i := 0; i < 4; i++ {
+		a := coeffs[i+0] + coeffs[i+8]
+		b := coeffs[i+0] - coeffs[i+8]
+		c := (coeffs[i+4]*c2)>>16 - (coeffs[i+12]*c1)>>16
+		d := (coeffs[i+4]*c1)>>16 + (coeffs[i+12]*c2)>>16
+		m[i][0] = a + d
+		m[i][1] = b + c
+		m[i][2] = b - c
+		m[i][3] = a - d
+	}
+	for j := 0; j < 4; j++ {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		c := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		row := pix[j*stride:]
+		row[0] = clip8(int32(row[0]) + (a+d)>>3)
+		row[1] = clip8(int32(row[1]) + (b+c)>>3)
+		row[2] = clip8(int32(row[2]) + (b-c)>>3)
+		row[3] = clip8(int32(row[3]) + (a-d)>>3)
+	}
+}
+
+// iwht returns the DC coefficients of the 16 luma blocks from the second
+// order coefficients
+func iwht(in *[16]int32) (out [16]int32) {
+	var m [16]int32
+	for i := 0; i < 4; i++ {
+		a0 := in[0+i] + in[12+i]
+		a1 := in[4+i] + in[8+i]
+		a2 := in[4+i] - in[8+i]
+		a3 := in[0+i] - in[12+i]
+		m[0+i] = a0 + a1
+		m[8+i] = a0 - a1
+		m[4+i] = a3 + a2
+		m[12+i] = a3 - a2
+	}
+	for i := 0; i < 4; i++ {
+		dc := m[0+i*4] + 3
+		a0 := dc + m[3+i*4]
+		a1 := m[1+i*4] + m[2+i*4]
+		a2 := m[1+i*4] - m[2+i*4]
+		a3 := dc - m[3+i*4]
+		out[i*4+0] = (a0 + a1) >> 3
+		out[i*4+1] = (a3 + a2) >> 3
+		out[i*4+2] = (a0 - a1) >> 3
+		out[i*4+3] = (a3 - a2) >> 3
+	}
+	return out
+}
+
+func clip8(v int32) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
@@ -0,0 +1,259 @@
+// Package webrtcclient is a headless peer for the demo servers. It opens a
+// session with the same /webrtc/open handshake as the demo page, can send a
+// synthetic VP8 track and hands the RTP it receives to the caller, which lets
+// tests run end to end without a browser.
+package webrtcclient
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jtestard/tinygo-webrtc/testpattern"
+	"github.com/jtestard/tinygo-webrtc/vp8enc"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// receiveQueueSize is the number of received packets buffered for the caller,
+// packets are dropped once it is full
+const receiveQueueSize = 1024
+
+// Options sets what a client sends and receives
+type Options struct {
+	// SendVideo adds a VP8 track to the offer, SendPattern streams on it
+	SendVideo bool
+	// ReceiveAudio offers to receive an audio track along with the video
+	ReceiveAudio bool
+	// Source picks a broadcast of videoFromFileWeb, the server picks when empty
+	Source string
+	// Configuration is the configuration of the peer connection, no ICE
+	// server is needed over loopback
+	Configuration webrtc.Configuration
+	// NetworkTypes restricts the candidates the client gathers, every type is
+	// gathered when empty
+	NetworkTypes []webrtc.NetworkType
+}
+
+// Packet is an RTP packet received from the server
+type Packet struct {
+	// Kind and MimeType describe the track the packet was received on
+	Kind     webrtc.RTPCodecType
+	MimeType string
+	RTP      *rtp.Packet
+	// Time is when the packet was read
+	Time time.Time
+}
+
+// Client is a session opened on a demo server
+type Client struct {
+	// ID is the session ID issued by the server
+	ID string
+
+	server         string
+	peerConnection *webrtc.PeerConnection
+	video          *webrtc.TrackLocalStaticSample
+	packets        chan Packet
+}
+
+// sessionResponse is the response of /webrtc/open
+type sessionResponse struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+}
+
+// errorResponse is the body of the server errors
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// errNoVideo is returned by SendPattern when the client has no video track
+var errNoVideo = errors.New("client was dialed without SendVideo")
+
+// Dial opens a session on the server at the base URL server, such as
+// http://localhost:8000. It returns once the answer is applied, ICE then
+// connects in the background.
+func Dial(server string, options Options) (c *Client, err error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err = mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	settingEngine := webrtc.SettingEngine{}
+	if len(options.NetworkTypes) > 0 {
+		settingEngine.SetNetworkTypes(options.NetworkTypes)
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(settingEngine))
+	pc, err := api.NewPeerConnection(options.Configuration)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			pc.Close()
+		}
+	}()
+	c = &Client{server: strings.TrimSuffix(server, "/"), peerConnection: pc, packets: make(chan Packet, receiveQueueSize)}
+
+	if options.SendVideo {
+		if c.video, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "webrtcclient"); err != nil {
+			return nil, err
+		}
+		if _, err = pc.AddTrack(c.video); err != nil {
+			return nil, err
+		}
+	} else if _, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		return nil, err
+	}
+	if options.ReceiveAudio {
+		if _, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			return nil, err
+		}
+	}
+	pc.OnTrack(c.receive)
+
+	// The offer is sent with every candidate, like the demo page does, so it
+	// is only complete once gathering is
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(offer); err != nil {
+		return nil, err
+	}
+	<-gathered
+
+	openURL := c.server + "/webrtc/open"
+	if options.Source != "" {
+		openURL += "?source=" + url.QueryEscape(options.Source)
+	}
+	resp, err := http.Post(openURL, "text/plain", strings.NewReader(encode(pc.LocalDescription())))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err = checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	session := sessionResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return nil, err
+	}
+	answer := webrtc.SessionDescription{}
+	if err = decode(session.Description, &answer); err != nil {
+		return nil, err
+	}
+	if err = pc.SetRemoteDescription(answer); err != nil {
+		return nil, err
+	}
+	c.ID = session.ID
+	return c, nil
+}
+
+// PeerConnection returns the peer connection of the client, to watch its state
+// or read its statistics
+func (c *Client) PeerConnection() *webrtc.PeerConnection {
+	return c.peerConnection
+}
+
+// Packets returns the RTP packets received from the server, on every track
+func (c *Client) Packets() <-chan Packet {
+	return c.packets
+}
+
+// receive reads the track until it ends
+func (c *Client) receive(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		select {
+		case c.packets <- Packet{Kind: track.Kind(), MimeType: track.Codec().MimeType, RTP: packet, Time: time.Now()}:
+		default:
+		}
+	}
+}
+
+// SendPattern streams the test pattern of width x height at fps frames per
+// second on the video track until ctx is done. It returns ctx.Err() then.
+func (c *Client) SendPattern(ctx context.Context, width, height, fps int) error {
+	if c.video == nil {
+		return errNoVideo
+	}
+	pattern := testpattern.New(width, height)
+	encoder := vp8enc.NewEncoder(vp8enc.DefaultQuantizer)
+	frameDuration := time.Second / time.Duration(fps)
+	ticker := time.NewTicker(frameDuration)
+	defer ticker.Stop()
+	for frame := 0; ; frame++ {
+		data, err := encoder.Encode(pattern.Frame(frame))
+		if err != nil {
+			return err
+		}
+		if err = c.video.WriteSample(media.Sample{Data: data, Duration: frameDuration}); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close closes the session on the server and the peer connection
+func (c *Client) Close() error {
+	resp, err := http.Post(c.server+"/webrtc/close?id="+url.QueryEscape(c.ID), "text/plain", nil)
+	if err == nil {
+		err = checkResponse(resp)
+		resp.Body.Close()
+	}
+	if closeErr := c.peerConnection.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// checkResponse turns an error response of the server into an error
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	e := errorResponse{}
+	if json.Unmarshal(body, &e) != nil || e.Code == "" {
+		return fmt.Errorf("server answered %s: %s", resp.Status, body)
+	}
+	return fmt.Errorf("server answered %s: %s (%s)", resp.Status, e.Message, e.Code)
+}
+
+// encode encodes obj as base64 JSON, the format the servers exchange session
+// descriptions in
+func encode(obj interface{}) string {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// decode decodes base64 JSON into obj
+func decode(in string, obj interface{}) error {
+	b, err := base64.StdEncoding.DecodeString(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, obj)
+}